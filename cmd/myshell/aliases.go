@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// shellAliases holds the aliases defined with `alias name=value`
+var shellAliases = map[string]string{}
+
+// aliasWordEnd are the characters that end the first word of a command
+const aliasWordEnd = " \t\n;|&<>()"
+
+func handleAliasCmd(args []string) {
+	if len(args) > 0 && args[0] == "-p" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		for _, name := range slices.Sorted(maps.Keys(shellAliases)) {
+			printAlias(name)
+		}
+		return
+	}
+
+	for _, arg := range args {
+		name, value, isDefinition := strings.Cut(arg, "=")
+		if !isDefinition {
+			if _, ok := shellAliases[name]; !ok {
+				fmt.Fprintf(os.Stderr, "alias: %s: not found\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			printAlias(name)
+			continue
+		}
+
+		if name == "" || strings.ContainsAny(name, aliasWordEnd+"'\"`$\\/=") {
+			fmt.Fprintf(os.Stderr, "alias: `%s': invalid alias name\n", name)
+			lastExitStatus = 1
+			continue
+		}
+		shellAliases[name] = value
+	}
+}
+
+func printAlias(name string) {
+	fmt.Printf("alias %s=%s\n", name, singleQuoteWord(shellAliases[name]))
+}
+
+func handleUnaliasCmd(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "unalias: usage: unalias [-a] name [name ...]")
+		lastExitStatus = 2
+		return
+	}
+	if args[0] == "-a" {
+		clear(shellAliases)
+		return
+	}
+
+	for _, name := range args {
+		if _, ok := shellAliases[name]; !ok {
+			fmt.Fprintf(os.Stderr, "unalias: %s: not found\n", name)
+			lastExitStatus = 1
+			continue
+		}
+		delete(shellAliases, name)
+	}
+}
+
+// expandAliases replaces the first word of a simple command with its
+// alias, and that of the result in turn, using each alias once so that
+// `alias ls='ls -F'` does not loop
+func expandAliases(input string) string {
+	expanded := map[string]bool{}
+	for {
+		end := strings.IndexAny(input, aliasWordEnd)
+		if end == -1 {
+			end = len(input)
+		}
+
+		name := input[:end]
+		value, ok := shellAliases[name]
+		if !ok || expanded[name] {
+			return input
+		}
+		expanded[name] = true
+		input = strings.TrimLeft(value+input[end:], " ")
+	}
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/user"
 	"path/filepath"
 	"slices"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -17,135 +19,367 @@ const (
 
 var tabCount = 0
 
-func autoComplete(input *strings.Builder) {
-	tabCount++
-	currentInput := input.String()
-	completed, matchType := tryAutoComplete(currentInput, tabCount)
+// completionContext describes the word being completed
+type completionContext struct {
+	line      string
+	cursor    int    // byte offset of the cursor in line
+	start     int    // where the word starts
+	word      string // the word up to the cursor, as typed
+	isCommand bool   // whether the word is in command position
+
+	// words are the words of the command being completed, as typed, with
+	// the word being completed at wordIndex
+	words     []string
+	wordIndex int
+}
+
+// newCompletionContext finds the word that ends at the cursor, which is
+// empty when the cursor follows a blank or an operator
+func newCompletionContext(line string, cursor int) completionContext {
+	ctx := completionContext{line: line, cursor: cursor, start: cursor}
+
+	tokens := tokenize(line[:cursor])
+	if n := len(tokens); n > 0 && !tokens[n-1].isOperator && tokens[n-1].end == cursor {
+		ctx.start = tokens[n-1].start
+		ctx.word = tokens[n-1].text
+		tokens = tokens[:n-1]
+	}
+	ctx.isCommand = isCommandPosition(tokens)
+
+	for _, tok := range tokens {
+		if tok.isOperator {
+			if commandSeparators[tok.text] {
+				ctx.words = nil
+			}
+			continue
+		}
+		ctx.words = append(ctx.words, tok.text)
+	}
+	ctx.wordIndex = len(ctx.words)
+	ctx.words = append(ctx.words, ctx.word)
 
-	if completed != currentInput && matchType == FullMatch {
-		// Clear current line and rewrite with completed text
-		fmt.Print("\r\033[K$ ")
-		fmt.Printf("%s ", completed)
-		os.Stdout.Sync() // Force flush
-		input.Reset()
-		input.WriteString(completed + " ")
+	for _, tok := range tokenize(line[cursor:]) {
+		if tok.isOperator && commandSeparators[tok.text] {
+			break
+		}
+		// A word starting at the cursor is the rest of the word being completed
+		if tok.isOperator || (tok.start == 0 && ctx.word != "") {
+			continue
+		}
+		ctx.words = append(ctx.words, tok.text)
+	}
+	return ctx
+}
 
+// commandName returns the command whose arguments are being completed,
+// the first word after any NAME=value assignments
+func (ctx completionContext) commandName() string {
+	for _, word := range ctx.words[:ctx.wordIndex] {
+		if !isAssignment(word) {
+			return unquoteCompletion(word)
+		}
+	}
+	return ""
+}
+
+// previousWord returns the word before the one being completed
+func (ctx completionContext) previousWord() string {
+	if ctx.wordIndex == 0 {
+		return ""
+	}
+	return unquoteCompletion(ctx.words[ctx.wordIndex-1])
+}
+
+// isCommandPosition reports whether a word following tokens is a command
+// name: the first word of the line, of a pipeline element, of a list item,
+// of a group or of a loop body, after any NAME=value assignments
+func isCommandPosition(tokens []token) bool {
+	for i := len(tokens) - 1; i >= 0; i-- {
+		previous := tokens[i]
+		if previous.isOperator {
+			return commandSeparators[previous.text]
+		}
+		if previous.text == "{" || previous.text == "do" {
+			return true
+		}
+		if !isAssignment(previous.text) {
+			return false
+		}
+	}
+	return true
+}
+
+// autoComplete completes the word before the cursor, ringing the bell
+// when there is no single completion. It returns the new line and cursor,
+// as byte offsets, and the candidates to list when Tab is pressed again
+// without anything to complete.
+func autoComplete(line string, cursor int) (string, int, []completion) {
+	tabCount++
+	ctx := newCompletionContext(line, cursor)
+	completed, matchType, matches := tryAutoComplete(ctx, tabCount)
+
+	if completed != ctx.word && matchType == FullMatch {
 		tabCount = 0 // Reset tab count after full match
+		line, cursor = insertCompletion(ctx, completed, true)
+		return line, cursor, nil
 	} else if matchType == NoMatch {
 		// if no completion, print bell sound
 		fmt.Print("\x07") // ASCII Bell
 	} else if matchType == MultipleMatch && tabCount > 1 {
-		// if multiple completions
-		fmt.Printf("$ %s", currentInput)
+		// the editor lists the candidates and redraws the line
 		tabCount = 0 // Reset tab count after multiple matches
+		return line, cursor, matches
 	} else if matchType == PartialMatch {
-		// Clear current line and rewrite with completed text
-		fmt.Print("\r\033[K$ ")
-		fmt.Printf("%s", completed)
-		os.Stdout.Sync() // Force flush
-		input.Reset()
-		input.WriteString(completed)
-
 		tabCount = 0 // Reset tab count after partial match
+		line, cursor = insertCompletion(ctx, completed, false)
+		return line, cursor, nil
 	}
+
+	return line, cursor, nil
 }
 
-func tryAutoComplete(input string, tabCount int) (string, int) {
-	input = strings.TrimSpace(input)
-	if input == "" {
-		return "", NoMatch
+// insertCompletion replaces the word being completed with text, adding a
+// space after it unless there is one already, and returns the new line
+// and cursor
+func insertCompletion(ctx completionContext, text string, addSpace bool) (string, int) {
+	before, after := ctx.line[:ctx.start], ctx.line[ctx.cursor:]
+	if !addSpace {
+		return before + text + after, len(before) + len(text)
 	}
 
-	var matches []string
-
-	// check if it is a built-in command
-	for _, cmd := range builtInCommands {
-		if strings.HasPrefix(cmd, input) {
-			matches = append(matches, cmd)
-		}
+	// A blank already after the cursor is stepped over
+	if !strings.HasPrefix(after, " ") {
+		after = " " + after
 	}
+	return before + text + after, len(before) + len(text) + 1
+}
 
-	// check if it an executable in PATH directory
-	if len(matches) == 0 {
-		executables, err := checkPATH()
-		if err != nil {
-			fmt.Printf("Error checking PATH: %v\n", err)
-			return input, NoMatch
-		}
+// completion is one candidate for the word being completed
+type completion struct {
+	text        string // replaces the word, escaped for the shell
+	display     string // shown when the candidates are listed
+	description string // shown next to display, when there is one
+	noSpace     bool   // set for directories, which get a / to go on typing
+}
 
-		for _, exec := range executables {
-			if strings.HasPrefix(exec, input) {
-				matches = append(matches, exec)
-			}
+// tryAutoComplete returns what the word being completed becomes, and the
+// candidates
+func tryAutoComplete(ctx completionContext, tabCount int) (string, int, []completion) {
+	word := ctx.word
+	if ctx.isCommand && word == "" {
+		return word, NoMatch, nil
+	}
+
+	var matches []completion
+	if spec := completionSpecFor(ctx.commandName()); spec != nil && !ctx.isCommand {
+		var err error
+		if matches, err = spec.completions(ctx); err != nil {
+			fmt.Printf("\n\rcompletion: %v\n\r", err)
 		}
+	} else if ctx.isCommand {
+		matches = commandCompletions(word)
+	} else {
+		matches = fileCompletions(word)
 	}
 
 	if len(matches) == 1 {
-		return matches[0], FullMatch
+		if matches[0].noSpace {
+			return matches[0].text, PartialMatch, matches
+		}
+		return matches[0].text, FullMatch, matches
 	} else if len(matches) > 1 {
-		// Multiple matches - Ring bell for 1st tab, print all for 2nd tab
+		// Multiple matches - Ring bell for 1st tab, list them on the 2nd
 		if tabCount == 1 {
 			fmt.Print("\a") // ASCII Bell
 
-			longestPrefix := longestCommonPrefix(matches)
+			texts := make([]string, len(matches))
+			for i, match := range matches {
+				texts[i] = match.text
+			}
+			longestPrefix := longestCommonPrefix(texts)
 
-			if longestPrefix != input {
-				return longestPrefix, PartialMatch
-			} else {
-				return input, MultipleMatch
+			if len(longestPrefix) > len(word) {
+				return longestPrefix, PartialMatch, matches
 			}
-		} else if tabCount > 1 {
-			slices.Sort(matches)
-			fmt.Printf("\n\r")
-			fmt.Printf("%s", strings.Join(matches, "  "))
-			fmt.Printf("\n\r")
+		}
+
+		slices.SortStableFunc(matches, func(a, b completion) int {
+			return strings.Compare(a.display, b.display)
+		})
+		return word, MultipleMatch, matches
+	}
 
-			return input, MultipleMatch
+	return word, NoMatch, nil
+}
+
+// commandCompletions returns the builtins starting with word, or the
+// executables in PATH when no builtin does
+func commandCompletions(word string) []completion {
+	var names []string
+
+	// check if it is a built-in command
+	for _, cmd := range builtInCommands {
+		if strings.HasPrefix(cmd, word) {
+			names = append(names, cmd)
 		}
 	}
 
-	return input, NoMatch
+	// check if it an executable in PATH directory
+	if len(names) == 0 {
+		names = pathExecutables(word)
+	}
+
+	matches := make([]completion, len(names))
+	for i, name := range names {
+		matches[i] = completion{text: escapeCompletion(name), display: name, description: builtinDescriptions[name]}
+	}
+	return matches
 }
 
-func checkPATH() ([]string, error) {
-	var executables []string
+// builtinDescriptions are shown next to builtins in the completion menu
+var builtinDescriptions = map[string]string{
+	"alias":    "define or print aliases",
+	"cd":       "change the working directory",
+	"compgen":  "print the completions of a word",
+	"complete": "set how arguments of a command are completed",
+	"declare":  "set variables and their attributes",
+	"echo":     "write arguments to standard output",
+	"exit":     "exit the shell",
+	"fc":       "edit and run history entries",
+	"hash":     "remember where commands are in PATH",
+	"history":  "show and edit the command history",
+	"printf":   "format and print arguments",
+	"pwd":      "print the working directory",
+	"read":     "read a line into variables",
+	"set":      "set shell options",
+	"type":     "tell how a command name is run",
+	"unalias":  "remove aliases",
+	"unset":    "remove variables and functions",
+}
 
-	pathEnv := os.Getenv("PATH")
-	if pathEnv == "" {
-		return nil, fmt.Errorf("PATH environment variable is not set")
+// fileCompletions returns the files and directories whose path starts
+// with word
+func fileCompletions(word string) []completion {
+	var matches []completion
+	for _, path := range matchFiles(unquoteCompletion(word), false) {
+		matches = append(matches, fileCompletion(path))
 	}
+	return matches
+}
 
-	pathDirs := strings.Split(pathEnv, pathSeparator)
-	for _, dir := range pathDirs {
-		// read directory
-		files, err := os.ReadDir(dir)
-		if err != nil {
-			continue
+// fileCompletion escapes path and marks a directory with a slash
+func fileCompletion(path string) completion {
+	isDir := false
+	if info, err := os.Stat(path); err == nil {
+		// Stat follows symlinks, so a link to a directory completes like one
+		isDir = info.IsDir()
+	}
+	if isDir && !strings.HasSuffix(path, "/") {
+		path += "/"
+	}
+
+	display := path[strings.LastIndexByte(strings.TrimSuffix(path, "/"), '/')+1:]
+	return completion{text: escapeCompletion(path), display: display, noSpace: isDir}
+}
+
+// matchFiles returns the paths starting with prefix, or only the
+// directories among them. A leading ~ or ~user is replaced by the home
+// directory, and hidden files are only matched when the name being
+// completed starts with a dot.
+func matchFiles(prefix string, dirsOnly bool) []string {
+	// ~ and ~user on their own complete to the home directory
+	if strings.HasPrefix(prefix, "~") && !strings.Contains(prefix, "/") {
+		if home := expandTilde(prefix + "/"); home != prefix+"/" {
+			return []string{home}
 		}
+		return nil
+	}
+	path := expandTilde(prefix)
 
-		for _, file := range files {
-			if !file.IsDir() {
-				fileName := file.Name()
+	dir, base := "", path
+	if slash := strings.LastIndexByte(path, '/'); slash >= 0 {
+		dir, base = path[:slash+1], path[slash+1:]
+	}
 
-				if isExecutable(filepath.Join(dir, fileName)) {
-					executables = append(executables, fileName)
-				}
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if dirsOnly {
+			if info, err := os.Stat(filepath.Join(readDir, name)); err != nil || !info.IsDir() {
+				continue
 			}
 		}
+		paths = append(paths, dir+name)
 	}
+	return paths
+}
 
-	return executables, nil
+// expandTilde replaces a leading ~ or ~user with the home directory. The
+// shell does not expand ~ in arguments, so completion does it instead.
+func expandTilde(path string) string {
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+
+	name, rest, _ := strings.Cut(path[1:], "/")
+	var home string
+	if name == "" {
+		home = os.Getenv("HOME")
+	} else if account, err := user.Lookup(name); err == nil {
+		home = account.HomeDir
+	}
+	if home == "" {
+		return path
+	}
+	return strings.TrimSuffix(home, "/") + "/" + rest
 }
 
-func isExecutable(filePath string) bool {
-	info, err := os.Stat(filePath)
-	if err != nil {
-		return false
+// unquoteCompletion removes the quotes and backslashes of a partly typed
+// word, which may have an unclosed quote
+func unquoteCompletion(word string) string {
+	var unquoted strings.Builder
+	var quote byte
+	for i := 0; i < len(word); i++ {
+		char := word[i]
+		switch {
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote == 0 && (char == singleQuote || char == doubleQuote):
+			quote = char
+		case char == backslash && quote != singleQuote && i+1 < len(word):
+			i++
+			unquoted.WriteByte(word[i])
+		default:
+			unquoted.WriteByte(char)
+		}
 	}
+	return unquoted.String()
+}
+
+// completionSpecialChars are escaped with a backslash in completed names
+const completionSpecialChars = " \t\n\\'\"`$&|;<>()[]{}*?!#~="
 
-	// Check if file has execute permission
-	mode := info.Mode()
-	return mode&0111 != 0 // Check if any execute bit is set
+func escapeCompletion(name string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		if strings.IndexByte(completionSpecialChars, name[i]) >= 0 {
+			escaped.WriteByte(backslash)
+		}
+		escaped.WriteByte(name[i])
+	}
+	return escaped.String()
 }
 
 func longestCommonPrefix(matches []string) string {
@@ -160,5 +394,9 @@ func longestCommonPrefix(matches []string) string {
 		}
 	}
 
+	// Bytes of a character the matches differ in are not common to them
+	for !utf8.ValidString(longestPrefix) {
+		longestPrefix = longestPrefix[:len(longestPrefix)-1]
+	}
 	return longestPrefix
 }
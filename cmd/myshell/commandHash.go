@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const hashUsage = "hash: usage: hash [-lr] [-p pathname] [-dt] [name ...]"
+
+// pathDir is the files of one PATH directory as of its modification time,
+// which changes whenever a file is added, removed or renamed in it. Making
+// a file executable does not change it, so that is checked on lookup.
+type pathDir struct {
+	modTime time.Time
+	names   []string
+}
+
+// pathIndex caches the files in PATH so completion, `type` and running a
+// command do not read every directory each time. Directories are read
+// again when PATH or their modification time changes.
+var pathIndex struct {
+	path     string
+	dirs     map[string]*pathDir
+	commands map[string][]string // name to its full paths, in PATH order
+}
+
+// hashedCommand is an entry of the table `hash` shows: a command that was
+// run, looked up with `hash name`, or set with `hash -p`
+type hashedCommand struct {
+	path     string
+	hits     int
+	explicit bool // set with hash -p, so it is kept until hash -r
+}
+
+var hashedCommands = map[string]*hashedCommand{}
+
+// copyHashedCommands copies the hash table, hit counts included
+func copyHashedCommands() map[string]*hashedCommand {
+	commands := make(map[string]*hashedCommand, len(hashedCommands))
+	for name, hashed := range hashedCommands {
+		copied := *hashed
+		commands[name] = &copied
+	}
+	return commands
+}
+
+// refreshPathIndex brings the index up to date with PATH, which costs one
+// stat per directory when nothing changed. Commands that were hashed from
+// PATH are forgotten when it changes, as their place in it may have.
+func refreshPathIndex() {
+	path := os.Getenv("PATH")
+	changed := path != pathIndex.path || pathIndex.commands == nil
+	if path != pathIndex.path {
+		pathIndex.path = path
+		pathIndex.dirs = map[string]*pathDir{}
+	}
+
+	directories := strings.Split(path, pathSeparator)
+	for _, directory := range directories {
+		if directory == "" {
+			continue
+		}
+
+		var modTime time.Time
+		if info, err := os.Stat(directory); err == nil {
+			modTime = info.ModTime()
+		}
+		if cached, ok := pathIndex.dirs[directory]; ok && cached.modTime.Equal(modTime) {
+			continue
+		}
+
+		pathIndex.dirs[directory] = &pathDir{modTime: modTime, names: readFileNames(directory)}
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	pathIndex.commands = map[string][]string{}
+	for _, directory := range directories {
+		if cached, ok := pathIndex.dirs[directory]; ok {
+			for _, name := range cached.names {
+				pathIndex.commands[name] = append(pathIndex.commands[name], filepath.Join(directory, name))
+			}
+		}
+	}
+
+	for name, hashed := range hashedCommands {
+		if !hashed.explicit {
+			delete(hashedCommands, name)
+		}
+	}
+}
+
+// readFileNames returns the names of the files in directory
+func readFileNames(directory string) []string {
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	return names
+}
+
+// pathExecutables returns the names of the commands in PATH that start
+// with prefix. Only those are checked for being executable.
+func pathExecutables(prefix string) []string {
+	refreshPathIndex()
+
+	var names []string
+	for name := range pathIndex.commands {
+		if strings.HasPrefix(name, prefix) {
+			if _, ok := findInPath(name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// findInPath returns the first executable file called name in PATH
+func findInPath(name string) (string, bool) {
+	for _, path := range pathIndex.commands[name] {
+		if isExecutable(path) {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// lookupCommand returns the file a command name runs: the name itself when
+// it has a slash, else its hashed path or where it is in PATH. A hashed
+// file that is gone is searched for again, as in bash.
+func lookupCommand(name string) (string, bool) {
+	if strings.Contains(name, "/") {
+		return name, isExecutable(name)
+	}
+
+	refreshPathIndex()
+	if hashed, ok := hashedCommands[name]; ok {
+		if hashed.explicit || isExecutable(hashed.path) {
+			return hashed.path, true
+		}
+		delete(hashedCommands, name)
+	}
+	return findInPath(name)
+}
+
+// hashCommand looks up a command that is about to run and counts the hit
+func hashCommand(name string) (string, bool) {
+	path, ok := lookupCommand(name)
+	if !ok || strings.Contains(name, "/") {
+		return path, ok
+	}
+
+	hashed, ok := hashedCommands[name]
+	if !ok {
+		hashed = &hashedCommand{path: path}
+		hashedCommands[name] = hashed
+	}
+	hashed.hits++
+	return path, true
+}
+
+func handleHashCmd(args []string) {
+	var reset, list, remove, show bool
+	explicitPath := ""
+
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && len(args[i]) > 1; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+
+		for j := 1; j < len(args[i]); j++ {
+			switch args[i][j] {
+			case 'r':
+				reset = true
+			case 'l':
+				list = true
+			case 'd':
+				remove = true
+			case 't':
+				show = true
+			case 'p':
+				// The path is the rest of the argument or the next one
+				explicitPath = args[i][j+1:]
+				if explicitPath == "" {
+					i++
+					if i >= len(args) {
+						fmt.Fprintln(os.Stderr, "hash: -p: option requires an argument")
+						fmt.Fprintln(os.Stderr, hashUsage)
+						lastExitStatus = 2
+						return
+					}
+					explicitPath = args[i]
+				}
+				j = len(args[i])
+			default:
+				fmt.Fprintf(os.Stderr, "hash: -%c: invalid option\n", args[i][j])
+				fmt.Fprintln(os.Stderr, hashUsage)
+				lastExitStatus = 2
+				return
+			}
+		}
+	}
+	names := args[i:]
+
+	if reset {
+		clear(hashedCommands)
+	}
+
+	switch {
+	case explicitPath != "":
+		if len(names) == 0 {
+			fmt.Fprintln(os.Stderr, "hash: -p: name required")
+			fmt.Fprintln(os.Stderr, hashUsage)
+			lastExitStatus = 2
+			return
+		}
+		for _, name := range names {
+			hashedCommands[name] = &hashedCommand{path: explicitPath, explicit: true}
+		}
+
+	case remove:
+		for _, name := range names {
+			if _, ok := hashedCommands[name]; !ok {
+				fmt.Fprintf(os.Stderr, "hash: %s: not found\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			delete(hashedCommands, name)
+		}
+
+	case show:
+		for _, name := range names {
+			hashed, ok := hashedCommands[name]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "hash: %s: not found\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			if len(names) > 1 {
+				fmt.Printf("%s\t%s\n", name, hashed.path)
+			} else {
+				fmt.Println(hashed.path)
+			}
+		}
+
+	case len(names) > 0 && !list:
+		// Names are looked up in PATH again, and builtins are left out
+		refreshPathIndex()
+		for _, name := range names {
+			if slices.Contains(builtInCommands, name) {
+				continue
+			}
+			path, ok := findInPath(name)
+			if strings.Contains(name, "/") || !ok {
+				fmt.Fprintf(os.Stderr, "hash: %s: not found\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			hashedCommands[name] = &hashedCommand{path: path}
+		}
+
+	case !reset || list:
+		printHashedCommands(names, list)
+	}
+}
+
+// printHashedCommands lists the hash table, or the given names in it, as
+// hits and paths or, for -l, as commands that restore it
+func printHashedCommands(names []string, asCommands bool) {
+	if len(names) == 0 {
+		for name := range hashedCommands {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	if len(names) == 0 {
+		fmt.Println("hash: hash table empty")
+		return
+	}
+
+	if !asCommands {
+		fmt.Println("hits\tcommand")
+	}
+	for _, name := range names {
+		hashed, ok := hashedCommands[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "hash: %s: not found\n", name)
+			lastExitStatus = 1
+			continue
+		}
+
+		if asCommands {
+			fmt.Printf("builtin hash -p %s %s\n", hashed.path, name)
+		} else {
+			fmt.Printf("%4d\t%s\n", hashed.hits, hashed.path)
+		}
+	}
+}
+
+func isExecutable(filePath string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	// Check if file has execute permission
+	mode := info.Mode()
+	return mode&0111 != 0 // Check if any execute bit is set
+}
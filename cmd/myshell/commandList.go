@@ -0,0 +1,492 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+type ListOperator int
+
+const (
+	NoOperator       ListOperator = iota
+	SequenceOperator              // ;
+	AndOperator                   // &&
+	OrOperator                    // ||
+)
+
+type GroupType int
+
+const (
+	NoGroup            GroupType = iota
+	SubshellGroup                // ( ... )
+	BraceGroup                   // { ...; }
+	ForLoop                      // for name in words; do ...; done
+	FunctionDefinition           // name() { ...; }
+)
+
+const listSeparator = ';'
+
+// loopOpen and loopClose are the reserved words around a for loop, which
+// nest like ( and )
+const (
+	loopOpen  = "for"
+	loopClose = "done"
+)
+
+// ListItem is one pipeline of a command list together with the operator
+// that links it to the next one.
+type ListItem struct {
+	Text string
+	Op   ListOperator
+}
+
+var lastExitStatus = 0
+
+// subshellDepth is > 0 while running the body of a ( ... ) group
+var subshellDepth = 0
+
+// subshellExit is raised by `exit` inside a subshell and recovered by runSubshell
+type subshellExit struct {
+	code int
+}
+
+// runCommandList parses and runs each item of a `;`, `&&` and `||` list in
+// turn. Items are parsed lazily so each one sees the effects of the previous.
+func runCommandList(input string) {
+	prevOp := NoOperator
+
+	for _, item := range splitCommandList(input) {
+		skip := (prevOp == AndOperator && lastExitStatus != 0) ||
+			(prevOp == OrOperator && lastExitStatus == 0)
+		prevOp = item.Op
+
+		if skip {
+			continue
+		}
+
+		parsedCmd := parseInput(item.Text)
+		if parsedCmd.Cmd == "" && parsedCmd.Group == NoGroup && len(parsedCmd.Assignments) == 0 {
+			continue
+		}
+
+		handleCommand(&parsedCmd)
+	}
+}
+
+func splitCommandList(input string) []ListItem {
+	var items []ListItem
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
+	depth := 0
+	start := 0
+
+	addItem := func(end int, op ListOperator) {
+		text := strings.TrimSpace(input[start:end])
+		if text != "" || op != SequenceOperator {
+			items = append(items, ListItem{Text: text, Op: op})
+		}
+	}
+
+	for i := 0; i < len(input); i++ {
+		char := input[i]
+
+		switch {
+		case char == backslash && !isInSingleQuotes:
+			i++ // an escaped quote does not end a double-quoted string
+		case char == singleQuote && !isInDoubleQuotes:
+			isInSingleQuotes = !isInSingleQuotes
+		case char == doubleQuote && !isInSingleQuotes:
+			isInDoubleQuotes = !isInDoubleQuotes
+		case isInSingleQuotes || isInDoubleQuotes:
+			continue
+		case char == subshellOpen || (char == groupOpen && isGroupOpen(input, i)):
+			depth++
+		case char == subshellClose || (char == groupClose && isGroupClose(input, i)):
+			depth--
+		case isKeywordAt(input, i, loopOpen):
+			depth++
+			i += len(loopOpen) - 1
+		case isKeywordAt(input, i, loopClose):
+			depth--
+			i += len(loopClose) - 1
+		case depth > 0:
+			continue
+		case char == listSeparator || char == '\n':
+			addItem(i, SequenceOperator)
+			start = i + 1
+		case char == '&' && i+1 < len(input) && input[i+1] == '&':
+			addItem(i, AndOperator)
+			i++
+			start = i + 1
+		case char == pipeline && i+1 < len(input) && input[i+1] == pipeline:
+			addItem(i, OrOperator)
+			i++
+			start = i + 1
+		}
+	}
+
+	addItem(len(input), NoOperator)
+	return items
+}
+
+// isGroupOpen reports whether the '{' at pos starts a brace group rather
+// than being part of a word like `a{b,c}`.
+func isGroupOpen(input string, pos int) bool {
+	atWordStart := pos == 0 || strings.ContainsRune(" ;|&(", rune(input[pos-1]))
+	followedBySpace := pos+1 < len(input) && input[pos+1] == whitespace
+	return atWordStart && followedBySpace
+}
+
+// isGroupClose reports whether the '}' at pos ends a brace group, which
+// bash only recognises in command position.
+func isGroupClose(input string, pos int) bool {
+	prefix := strings.TrimRight(input[:pos], " ")
+	return prefix == "" || strings.HasSuffix(prefix, ";") || strings.HasSuffix(prefix, "}") ||
+		hasWordSuffix(prefix, loopClose)
+}
+
+// isKeywordAt reports whether the reserved word keyword is at pos, which
+// it only is as a whole word in command position
+func isKeywordAt(input string, pos int, keyword string) bool {
+	if !strings.HasPrefix(input[pos:], keyword) {
+		return false
+	}
+	if end := pos + len(keyword); end < len(input) && !strings.ContainsRune(" ;\n", rune(input[end])) {
+		return false
+	}
+
+	prefix := strings.TrimRight(input[:pos], " ")
+	if len(prefix) == len(input[:pos]) && pos > 0 && !strings.ContainsRune(";&|({\n", rune(input[pos-1])) {
+		return false // inside a word
+	}
+	return prefix == "" || strings.ContainsRune(";&|({\n", rune(prefix[len(prefix)-1])) || hasWordSuffix(prefix, "do")
+}
+
+// hasWordSuffix reports whether s ends with the whole word
+func hasWordSuffix(s string, word string) bool {
+	if !strings.HasSuffix(s, word) {
+		return false
+	}
+	rest := s[:len(s)-len(word)]
+	return rest == "" || strings.ContainsRune(" ;&|({\n", rune(rest[len(rest)-1]))
+}
+
+// findKeyword returns where the reserved word keyword is in input, outside
+// quotes and nested commands, or -1
+func findKeyword(input string, keyword string) int {
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
+	depth := 0
+
+	for i := 0; i < len(input); i++ {
+		char := input[i]
+
+		switch {
+		case char == backslash && !isInSingleQuotes:
+			i++ // an escaped quote does not end a double-quoted string
+		case char == singleQuote && !isInDoubleQuotes:
+			isInSingleQuotes = !isInSingleQuotes
+		case char == doubleQuote && !isInSingleQuotes:
+			isInDoubleQuotes = !isInDoubleQuotes
+		case isInSingleQuotes || isInDoubleQuotes:
+			continue
+		case depth == 0 && isKeywordAt(input, i, keyword):
+			return i
+		case char == subshellOpen || (char == groupOpen && isGroupOpen(input, i)):
+			depth++
+		case char == subshellClose || (char == groupClose && isGroupClose(input, i)):
+			depth--
+		case isKeywordAt(input, i, loopOpen):
+			depth++
+			i += len(loopOpen) - 1
+		case isKeywordAt(input, i, loopClose):
+			depth--
+			i += len(loopClose) - 1
+		}
+	}
+
+	return -1
+}
+
+// findGroupEnd returns the index of the ')' or '}' matching the opener at 0
+func findGroupEnd(input string) int {
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
+	depth := 0
+
+	for i := 0; i < len(input); i++ {
+		char := input[i]
+
+		switch {
+		case char == backslash && !isInSingleQuotes:
+			i++ // an escaped quote does not end a double-quoted string
+		case char == singleQuote && !isInDoubleQuotes:
+			isInSingleQuotes = !isInSingleQuotes
+		case char == doubleQuote && !isInSingleQuotes:
+			isInDoubleQuotes = !isInDoubleQuotes
+		case isInSingleQuotes || isInDoubleQuotes:
+			continue
+		case char == subshellOpen || (char == groupOpen && isGroupOpen(input, i)):
+			depth++
+		case char == subshellClose || (char == groupClose && isGroupClose(input, i)):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case isKeywordAt(input, i, loopOpen):
+			depth++
+			i += len(loopOpen) - 1
+		case isKeywordAt(input, i, loopClose):
+			depth--
+			i += len(loopClose) - 1
+		}
+	}
+
+	return -1
+}
+
+func parseGroup(input string) ParsedCommand {
+	end := findGroupEnd(input)
+	if end == -1 {
+		fmt.Printf("syntax error: missing '%c'\n", closerFor(input[0]))
+		return ParsedCommand{}
+	}
+
+	groupType := SubshellGroup
+	if input[0] == groupOpen {
+		groupType = BraceGroup
+	}
+
+	body := strings.TrimSpace(input[1:end])
+	if body == "" {
+		fmt.Printf("syntax error near unexpected token `%c'\n", input[end])
+		return ParsedCommand{}
+	}
+
+	// Whatever follows the group may only be redirections
+	rest, redirects, err := extractRedirections(input[end+1:])
+	if err != nil {
+		fmt.Printf("Error processing redirection: %v\n", err)
+		return ParsedCommand{}
+	}
+	if rest != "" {
+		fmt.Printf("syntax error near unexpected token `%s'\n", strings.Fields(rest)[0])
+		return ParsedCommand{}
+	}
+
+	return ParsedCommand{
+		Group:     groupType,
+		GroupBody: body,
+		Redirects: redirects,
+	}
+}
+
+// parseForLoop parses `for name [in words]; do list; done`. The words are
+// expanded here, as items are parsed just before they run.
+func parseForLoop(input string) ParsedCommand {
+	header := input[len(loopOpen):]
+	doPos := findKeyword(header, "do")
+	if doPos == -1 {
+		fmt.Println("syntax error: missing `do'")
+		return ParsedCommand{}
+	}
+
+	rest := header[doPos+len("do"):]
+	donePos := findKeyword(rest, loopClose)
+	if donePos == -1 {
+		fmt.Println("syntax error: missing `done'")
+		return ParsedCommand{}
+	}
+
+	body := strings.TrimSpace(rest[:donePos])
+	if body == "" {
+		fmt.Printf("syntax error near unexpected token `%s'\n", loopClose)
+		return ParsedCommand{}
+	}
+	if body[0] == listSeparator {
+		fmt.Printf("syntax error near unexpected token `%c'\n", listSeparator)
+		return ParsedCommand{}
+	}
+
+	header = strings.TrimSpace(header[:doPos])
+	header = strings.TrimSpace(strings.TrimSuffix(header, string(listSeparator)))
+	name, list, _ := strings.Cut(header, " ")
+	if !isValidVarName(name) {
+		fmt.Printf("syntax error: `%s': not a valid identifier\n", name)
+		return ParsedCommand{}
+	}
+
+	// Without `in words` the loop is over the positional parameters
+	words := slices.Clone(positionalParams)
+	if list = strings.TrimSpace(list); list != "" {
+		in, list, _ := strings.Cut(list, " ")
+		if in != "in" {
+			fmt.Printf("syntax error near unexpected token `%s'\n", in)
+			return ParsedCommand{}
+		}
+
+		tokens, err := splitWords(list)
+		if err != nil {
+			fmt.Println(err)
+			return ParsedCommand{}
+		}
+		words = tokens.words
+	}
+
+	// Whatever follows the loop may only be redirections
+	trailing, redirects, err := extractRedirections(rest[donePos+len(loopClose):])
+	if err != nil {
+		fmt.Printf("Error processing redirection: %v\n", err)
+		return ParsedCommand{}
+	}
+	if trailing != "" {
+		fmt.Printf("syntax error near unexpected token `%s'\n", strings.Fields(trailing)[0])
+		return ParsedCommand{}
+	}
+
+	return ParsedCommand{
+		Group:     ForLoop,
+		GroupBody: body,
+		LoopVar:   name,
+		LoopWords: words,
+		Redirects: redirects,
+	}
+}
+
+func closerFor(opener byte) byte {
+	if opener == groupOpen {
+		return groupClose
+	}
+	return subshellClose
+}
+
+func runGroup(cmd *ParsedCommand) {
+	if cmd.Group == SubshellGroup {
+		runSubshell(cmd.GroupBody)
+		return
+	}
+	if cmd.Group == ForLoop {
+		runForLoop(cmd)
+		return
+	}
+	if cmd.Group == FunctionDefinition {
+		shellFunctions[cmd.FuncName] = cmd.GroupBody
+		lastExitStatus = 0
+		return
+	}
+
+	runCommandList(cmd.GroupBody)
+}
+
+// runForLoop runs the body once for each word, with the word in the loop
+// variable. A loop over no words succeeds.
+func runForLoop(cmd *ParsedCommand) {
+	lastExitStatus = 0
+	for _, word := range cmd.LoopWords {
+		setVar(cmd.LoopVar, word)
+		runCommandList(cmd.GroupBody)
+	}
+}
+
+// shellState is the part of the shell a subshell may change but must not
+// leak back to its parent.
+type shellState struct {
+	workingDir string
+	environ    []string
+	vars       map[string]*Variable
+
+	// the std streams, which pipes and redirections inside may leave
+	// changed when exit unwinds through them
+	stdin, stdout, stderr *os.File
+
+	options             map[string]bool
+	history             []HistoryEntry
+	knownHistory        map[string]bool
+	lastCommandPos      int
+	currentLineRecorded bool
+	completionSpecs     map[string]*completionSpec
+	hashedCommands      map[string]*hashedCommand
+	functions           map[string]string
+	positionalParams    []string
+	aliases             map[string]string
+}
+
+func saveShellState() shellState {
+	dir, _ := os.Getwd()
+	return shellState{
+		workingDir: dir,
+		environ:    os.Environ(),
+		vars:       copyShellVars(),
+		stdin:      os.Stdin,
+		stdout:     os.Stdout,
+		stderr:     os.Stderr,
+
+		options:             maps.Clone(shellOptions),
+		history:             slices.Clone(HISTORY),
+		knownHistory:        maps.Clone(knownHistory),
+		lastCommandPos:      lastCommandPos,
+		currentLineRecorded: currentLineRecorded,
+		completionSpecs:     maps.Clone(completionSpecs),
+		hashedCommands:      copyHashedCommands(),
+		functions:           maps.Clone(shellFunctions),
+		positionalParams:    positionalParams,
+		aliases:             maps.Clone(shellAliases),
+	}
+}
+
+func (state shellState) restore() {
+	if state.workingDir != "" {
+		os.Chdir(state.workingDir)
+	}
+
+	os.Clearenv()
+	for _, entry := range state.environ {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			os.Setenv(key, value)
+		}
+	}
+
+	shellVars = state.vars
+	os.Stdin, os.Stdout, os.Stderr = state.stdin, state.stdout, state.stderr
+
+	shellOptions = state.options
+	HISTORY = state.history
+	knownHistory = state.knownHistory
+	lastCommandPos = state.lastCommandPos
+	currentLineRecorded = state.currentLineRecorded
+	completionSpecs = state.completionSpecs
+	hashedCommands = state.hashedCommands
+	shellFunctions = state.functions
+	positionalParams = state.positionalParams
+	shellAliases = state.aliases
+}
+
+// runSubshell runs body against a snapshot of the shell state which is put
+// back afterwards, so `(cd build && make)` leaves the parent where it was.
+func runSubshell(body string) {
+	runInSubshell(func() { runCommandList(body) })
+}
+
+// runInSubshell runs run as a subshell, where exit only ends run
+func runInSubshell(run func()) {
+	state := saveShellState()
+	subshellDepth++
+
+	defer func() {
+		subshellDepth--
+		state.restore()
+
+		if r := recover(); r != nil {
+			exit, ok := r.(subshellExit)
+			if !ok {
+				panic(r)
+			}
+			lastExitStatus = exit.code
+		}
+	}()
+
+	run()
+}
@@ -6,30 +6,41 @@ import (
 	"os/exec"
 	"slices"
 	"strconv"
-	"strings"
 )
 
 type ParsedCommand struct {
-	Cmd       string
-	Args      []string
-	RedirType RedirectionType
-	RedirFile string
-	PipedCmd  *ParsedCommand
+	Cmd          string
+	Args         []string
+	Assignments  []Assignment     // leading NAME=value words
+	CompoundArgs map[int][]string // elements of NAME=(...) arguments, by Args index
+	Redirects    []Redirection
+	ProcSubsts   []ProcessSubstitution
+	PipedCmd     *ParsedCommand
+	Group        GroupType
+	GroupBody    string   // raw command list inside ( ... ) or { ...; }, or of a loop
+	LoopVar      string   // the variable of a for loop
+	LoopWords    []string // the expanded words a for loop runs over
+	FuncName     string   // the name a function definition binds
 }
 
 func handleTypeCmd(args []string) {
 	if len(args) == 0 {
 		fmt.Println("type: missing argument")
+		lastExitStatus = 1
 		return
 	}
 
-	if slices.Contains(builtInCommands, args[0]) {
+	if value, ok := shellAliases[args[0]]; ok {
+		fmt.Printf("%s is aliased to `%s'\n", args[0], value)
+	} else if isFunction(args[0]) {
+		fmt.Printf("%s is a function\n", args[0])
+	} else if slices.Contains(builtInCommands, args[0]) {
 		fmt.Printf("%s is a shell builtin\n", args[0])
-	} else if path, ok := isOnPath(args[0]); ok {
-		fullPath := path + "/" + args[0]
-		fmt.Printf("%s is %s\n", args[0], fullPath)
+	} else if path, ok := lookupCommand(args[0]); ok {
+		fmt.Printf("%s is %s\n", args[0], path)
 	} else {
 		fmt.Printf("%s not found\n", args[0])
+		lastExitStatus = 1
 	}
 }
 
@@ -53,22 +64,34 @@ func handleCdCmd(args []string) {
 	err := os.Chdir(path)
 	if err != nil {
 		fmt.Printf("cd: %s: No such file or directory\n", path)
+		lastExitStatus = 1
 		return
 	}
 }
 
-func displayCmd(cmd ParsedCommand, input *strings.Builder) {
-	// clear the input and terminal
-	fmt.Print("\r\033[K")
-	input.Reset()
+// pipeStarted is what is left to do once the last command of a pipeline
+// has started: close the shell's copies of the pipe readers, and run the
+// left sides that run in the shell itself, which would otherwise fill their
+// pipe before anything reads it
+var pipeStarted []func()
 
-	fmt.Printf("$ %s", cmd.Cmd)
-	input.WriteString(cmd.Cmd)
+// runPipeStarted does what was waiting for the pipeline to start, the
+// innermost pipe first
+func runPipeStarted() {
+	started := pipeStarted
+	pipeStarted = nil
+	for i := len(started) - 1; i >= 0; i-- {
+		started[i]()
+	}
+}
 
-	for _, arg := range cmd.Args {
-		fmt.Printf(" %s", arg)
-		input.WriteString(" " + arg)
+// startsExternally reports whether cmd, on the right of a pipe, starts an
+// external command without reading its input first
+func startsExternally(cmd *ParsedCommand) bool {
+	if cmd.Group != NoGroup || cmd.Cmd == "" || runsInShell(cmd.Cmd) {
+		return false
 	}
+	return cmd.PipedCmd == nil || startsExternally(cmd.PipedCmd)
 }
 
 func handlePipeCmd(cmd *ParsedCommand) {
@@ -78,45 +101,102 @@ func handlePipeCmd(cmd *ParsedCommand) {
 		return
 	}
 
-	// Execute left CMD
-	if slices.Contains(builtInCommands, cmd.Cmd) {
-		// For builtin commands, redirect stdout
+	// Execute left CMD. Like every part of a pipeline in bash it cannot
+	// change the shell, so its redirections and NAME=value prefixes are set
+	// up and undone around it.
+	left := *cmd
+	left.PipedCmd = nil
+
+	if cmd.Group != NoGroup || cmd.Cmd == "" || runsInShell(cmd.Cmd) {
+		// For builtins, functions, groups and lone assignments, redirect stdout
+		stdin := os.Stdin
+		writeLeft := func() {
+			originalStdout, originalStdin := os.Stdout, os.Stdin
+			defer func() {
+				os.Stdout, os.Stdin = originalStdout, originalStdin
+				writer.Close()
+			}()
+			os.Stdout, os.Stdin = writer, stdin
+
+			runInSubshell(func() { handleCommand(&left) })
+		}
+
+		if startsExternally(cmd.PipedCmd) {
+			// The started commands have their own copies of the reader, so
+			// closing the shell's lets them stop the left side by exiting
+			pipeStarted = append(pipeStarted, func() {
+				reader.Close()
+				writeLeft()
+			})
+		} else {
+			writeLeft()
+		}
+	} else {
+		// For external commands, use exec with pipe
 		originalStdout := os.Stdout
 		os.Stdout = writer
+		setup := setUpCommand(&left)
+
+		var leftCmd *exec.Cmd
+		if setup.cmd != nil {
+			leftCmd = newExternalCommand(setup.cmd.Cmd, setup.cmd.Args)
+			leftCmd.Stdout = os.Stdout
+			leftCmd.Stderr = os.Stderr
+			leftCmd.Stdin = os.Stdin
+			leftCmd.ExtraFiles = setup.extraFiles
 
-		executeBuiltinCommand(cmd)
+			if startsExternally(cmd.PipedCmd) {
+				pipeStarted = append(pipeStarted, func() { reader.Close() })
+			}
 
+			// Started here so it has the reader before runPipeStarted closes
+			// the shell's copy
+			if err := leftCmd.Start(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: command not found\n", cmd.Cmd)
+				leftCmd = nil
+			}
+		}
+
+		// The process has its own copies of the streams and environment
+		setup.restore()
 		os.Stdout = originalStdout
-		writer.Close()
-	} else {
-		// For external commands, use exec with pipe
-		leftCmd := exec.Command(cmd.Cmd, cmd.Args...)
-		leftCmd.Stdout = writer
-		leftCmd.Stderr = os.Stderr
-		leftCmd.Stdin = os.Stdin
 
 		go func() {
 			defer writer.Close()
-			leftCmd.Run()
+			if leftCmd != nil {
+				leftCmd.Wait()
+			}
+			setup.finish()
 		}()
 	}
 
-	// Execute right CMD with input from left side
+	// Execute right CMD with input from left side. Stdin is put back even
+	// when exit in a subshell unwinds through the pipe.
 	originalStdin := os.Stdin
 	os.Stdin = reader
+	defer func() {
+		os.Stdin = originalStdin
+		reader.Close()
 
-	handleCommand(cmd.PipedCmd) // Recursive for multiple pipes
+		// The right side did not start, so nothing reads what the left writes
+		if len(pipeStarted) > 0 {
+			status := lastExitStatus
+			runPipeStarted()
+			lastExitStatus = status
+		}
+	}()
 
-	os.Stdin = originalStdin
-	reader.Close()
+	handleCommand(cmd.PipedCmd) // Recursive for multiple pipes
 }
 
+// executeBuiltinCommand runs a builtin other than exit, which
+// handleCommand runs itself
 func executeBuiltinCommand(cmd *ParsedCommand) {
 	switch cmd.Cmd {
 	case "echo":
-		if len(cmd.Args) > 0 {
-			fmt.Println(strings.Join(cmd.Args, " "))
-		}
+		handleEchoCmd(cmd.Args)
+	case "printf":
+		handlePrintfCmd(cmd.Args)
 	case "type":
 		handleTypeCmd(cmd.Args)
 	case "pwd":
@@ -124,33 +204,85 @@ func executeBuiltinCommand(cmd *ParsedCommand) {
 	case "cd":
 		handleCdCmd(cmd.Args)
 	case "history":
-		displayCmdHistory(cmd.Args)
+		handleHistoryCmd(cmd.Args)
+	case "read":
+		handleReadCmd(cmd.Args)
+	case "declare":
+		handleDeclareCmd(cmd.Args, cmd.CompoundArgs)
+	case "set":
+		handleSetCmd(cmd.Args)
+	case "fc":
+		handleFcCmd(cmd.Args)
+	case "unset":
+		handleUnsetCmd(cmd.Args)
+	case "complete":
+		handleCompleteCmd(cmd.Args)
+	case "compgen":
+		handleCompgenCmd(cmd.Args)
+	case "hash":
+		handleHashCmd(cmd.Args)
+	case "alias":
+		handleAliasCmd(cmd.Args)
+	case "unalias":
+		handleUnaliasCmd(cmd.Args)
 	}
 }
 
 func handleHistoryCmd(args []string) {
 	if len(args) > 0 {
 		switch args[0] {
-		case "-r": // read from history file into HISTORY
-			if len(args) < 2 {
+		case "-r", "-w", "-a", "-n":
+			// The file defaults to HISTFILE, as in bash
+			fileName := getVar("HISTFILE")
+			if len(args) > 1 {
+				fileName = args[1]
+			}
+			if fileName == "" {
 				fmt.Println("history: missing filename")
+				lastExitStatus = 1
 				return
 			}
-			addContentsToHistory(args[1])
 
-		case "-w": // write current HISTORY to file
-			if len(args) < 2 {
-				fmt.Println("history: missing filename")
-				return
+			switch args[0] {
+			case "-r": // read from history file into HISTORY
+				addContentsToHistory(fileName)
+			case "-w": // write current HISTORY to file
+				writeHistoryToFile(fileName, false)
+			case "-a": // append new HISTORY entries to file
+				writeHistoryToFile(fileName, true)
+			case "-n": // read entries other sessions added to the file
+				mergeHistoryFile(fileName)
 			}
-			writeHistoryToFile(args[1], false)
 
-		case "-a": // append current HISTORY to file
+		case "-c":
+			clearHistory()
+
+		case "-d":
 			if len(args) < 2 {
-				fmt.Println("history: missing filename")
+				fmt.Fprintln(os.Stderr, "history: -d: option requires an argument")
+				fmt.Fprintln(os.Stderr, historyUsage)
+				lastExitStatus = 2
 				return
 			}
-			writeHistoryToFile(args[1], true)
+			if err := deleteHistory(args[1]); err != nil {
+				fmt.Fprintf(os.Stderr, "history: %v\n", err)
+				lastExitStatus = 1
+			}
+
+		case "-s": // store the arguments as an entry
+			storeHistory(args[1:])
+
+		case "-p": // print the history expansion of the arguments
+			printHistoryExpansion(args[1:])
+
+		case "stats":
+			handleHistoryStats(args[1:])
+
+		case "export":
+			handleHistoryExport(args[1:])
+
+		case "import":
+			handleHistoryImport(args[1:])
 
 		default:
 			displayCmdHistory(args)
@@ -163,8 +295,6 @@ func handleHistoryCmd(args []string) {
 }
 
 func handleExitCmd(args []string) {
-	saveHistoryOnExit()
-
 	// Handle exit code
 	exitCode := 0
 	if len(args) > 0 {
@@ -173,5 +303,11 @@ func handleExitCmd(args []string) {
 		}
 	}
 
+	// Inside ( ... ) only the subshell exits, see runSubshell
+	if subshellDepth > 0 {
+		panic(subshellExit{code: exitCode})
+	}
+
+	saveHistoryOnExit()
 	os.Exit(exitCode)
 }
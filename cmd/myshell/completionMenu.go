@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// completionQueryItems is how many candidates can be listed without asking
+// first, as readline's completion-query-items
+const completionQueryItems = 100
+
+// completionMenu is the state of the menu that a Tab after the candidates
+// were listed opens on them, to pick one with Tab and the arrow keys
+type completionMenu struct {
+	ctx      completionContext
+	matches  []completion
+	selected int
+	top      int // first row shown when the rows do not fit below the line
+
+	// the line being edited when the menu opened, restored by Esc or Ctrl+G
+	original       []rune
+	originalCursor int
+}
+
+// completionLayout is how candidates are arranged: one per row with their
+// descriptions when any has one, or in columns like ls, down then across
+type completionLayout struct {
+	columns         int
+	rows            int
+	cellWidth       int // widest candidate, plus the gap after it
+	hasDescriptions bool
+}
+
+func newCompletionLayout(matches []completion, width int) completionLayout {
+	layout := completionLayout{columns: 1}
+	for _, match := range matches {
+		layout.cellWidth = max(layout.cellWidth, displayWidth([]rune(match.display)))
+		if match.description != "" {
+			layout.hasDescriptions = true
+		}
+	}
+	layout.cellWidth += 2
+
+	// The last column needs no gap after it
+	if !layout.hasDescriptions {
+		layout.columns = max(1, (width+2)/layout.cellWidth)
+	}
+	layout.rows = (len(matches) + layout.columns - 1) / layout.columns
+	return layout
+}
+
+// completionRows renders the candidates for a terminal width columns wide,
+// with the selected one, if any, in reverse video
+func completionRows(matches []completion, width int, selected int) []string {
+	layout := newCompletionLayout(matches, width)
+	lines := make([]string, layout.rows)
+
+	for row := range lines {
+		var line strings.Builder
+		for column := 0; column < layout.columns; column++ {
+			i := column*layout.rows + row
+			if i >= len(matches) {
+				break
+			}
+
+			match := matches[i]
+			padding := strings.Repeat(" ", layout.cellWidth-displayWidth([]rune(match.display)))
+			cell := match.display
+			if layout.hasDescriptions && match.description != "" {
+				cell += padding + "-- " + truncateToWidth(match.description, width-layout.cellWidth-4)
+			}
+
+			if i == selected {
+				cell = "\033[7m" + cell + "\033[0m"
+			}
+			line.WriteString(cell)
+			if column < layout.columns-1 && i+layout.rows < len(matches) {
+				line.WriteString(padding)
+			}
+		}
+		lines[row] = line.String()
+	}
+	return lines
+}
+
+// terminalSize returns the width and height of the terminal, or 80x24
+// when it cannot be found
+func (e *LineEditor) terminalSize() (int, int) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// listCompletions prints the candidates below the line. It asks first when
+// there are many, and pages through more rows than the terminal has
+// like more(1). It reports whether they were listed.
+func (e *LineEditor) listCompletions(matches []completion) bool {
+	width, height := e.terminalSize()
+	fmt.Print("\r\n")
+
+	if len(matches) > completionQueryItems {
+		fmt.Printf("Display all %d possibilities? (y or n)", len(matches))
+		confirmed := e.confirm()
+		fmt.Print("\r\n")
+		if !confirmed {
+			return false
+		}
+	}
+
+	page := max(1, height-1)
+	shown := 0
+	for _, row := range completionRows(matches, width, -1) {
+		if shown == page {
+			fmt.Print("--More--")
+			key, err := e.readKey()
+			fmt.Print("\r\033[K")
+			switch {
+			case err != nil:
+				return true
+			case key.code == keyRune && key.char == ' ':
+				shown = 0 // a page more
+			case key.code == keyEnter:
+				shown-- // a line more
+			default:
+				return true
+			}
+		}
+
+		fmt.Print(row + "\r\n")
+		shown++
+	}
+	return true
+}
+
+// confirm reads keys until y or n is pressed. Space is yes; Esc and
+// Ctrl+C or Ctrl+G are no.
+func (e *LineEditor) confirm() bool {
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return false
+		}
+
+		switch {
+		case key.code == keyRune && (key.char == 'y' || key.char == 'Y' || key.char == ' '):
+			return true
+		case key.code == keyRune && (key.char == 'n' || key.char == 'N'):
+			return false
+		case key.code == keyEscape || (key.code == keyControl && (key.char == 'c' || key.char == 'g')):
+			return false
+		}
+	}
+}
+
+func (e *LineEditor) startMenu(matches []completion) {
+	line := string(e.buffer)
+	cursor := len(string(e.buffer[:e.cursor]))
+
+	e.menu = &completionMenu{
+		ctx:            newCompletionContext(line, cursor),
+		matches:        matches,
+		original:       slices.Clone(e.buffer),
+		originalCursor: e.cursor,
+	}
+	e.selectMenuItem(0)
+}
+
+// handleMenuKey handles a key while the completion menu is open. Tab and
+// the arrow keys move through the candidates, Enter takes the selected one
+// and Esc or Ctrl+G puts the word back. Any other key takes the selected
+// candidate and then does what it normally does.
+func (e *LineEditor) handleMenuKey(key keyPress) (bool, error) {
+	m := e.menu
+	width, _ := e.terminalSize()
+	layout := newCompletionLayout(m.matches, width)
+
+	across := layout.rows
+	if layout.columns == 1 {
+		across = 1
+	}
+
+	switch key.code {
+	case keyTab, keyDown:
+		e.selectMenuItem(m.selected + 1)
+	case keyBackTab, keyUp:
+		e.selectMenuItem(m.selected - 1)
+	case keyRight:
+		e.selectMenuItem(m.selected + across)
+	case keyLeft:
+		e.selectMenuItem(m.selected - across)
+	case keyEnter:
+		e.closeMenu(true)
+	case keyEscape:
+		e.closeMenu(false)
+	case keyControl:
+		switch key.char {
+		case 'c':
+			e.closeMenu(false)
+			return false, errInterrupted
+		case 'g':
+			e.closeMenu(false)
+		case 'n':
+			e.selectMenuItem(m.selected + 1)
+		case 'p':
+			e.selectMenuItem(m.selected - 1)
+		default:
+			e.closeMenu(true)
+			return e.handleKey(key)
+		}
+	default:
+		e.closeMenu(true)
+		return e.handleKey(key)
+	}
+	return false, nil
+}
+
+// selectMenuItem puts the candidate at index, wrapping around, in place
+// of the word and redraws the menu
+func (e *LineEditor) selectMenuItem(index int) {
+	m := e.menu
+	m.selected = (index%len(m.matches) + len(m.matches)) % len(m.matches)
+
+	line, cursor := insertCompletion(m.ctx, m.matches[m.selected].text, false)
+	e.buffer = []rune(line)
+	e.cursor = len([]rune(line[:cursor]))
+	e.refreshMenu()
+}
+
+// refreshMenu draws the line with the menu below it. When the rows do not
+// fit on the screen, only those around the selected one are shown.
+func (e *LineEditor) refreshMenu() {
+	m := e.menu
+	width, height := e.terminalSize()
+	rows := completionRows(m.matches, width, m.selected)
+
+	visible := max(1, height-2)
+	if len(rows) > visible {
+		selectedRow := m.selected % len(rows)
+		if selectedRow < m.top {
+			m.top = selectedRow
+		}
+		if selectedRow >= m.top+visible {
+			m.top = selectedRow - visible + 1
+		}
+		rows = rows[m.top : m.top+visible]
+	}
+
+	var out strings.Builder
+	out.WriteString("\r\033[J")
+	out.WriteString(e.modeIndicator())
+	out.WriteString(e.prompt)
+	out.WriteString(string(e.buffer))
+	for _, row := range rows {
+		out.WriteString("\r\n" + row)
+	}
+
+	// Back up to the line and put the cursor in place
+	if len(rows) > 0 {
+		fmt.Fprintf(&out, "\033[%dA", len(rows))
+	}
+	out.WriteString("\r")
+	if column := displayWidth([]rune(e.modeIndicator()+e.prompt)) + displayWidth(e.buffer[:e.cursor]); column > 0 {
+		fmt.Fprintf(&out, "\033[%dC", column)
+	}
+
+	fmt.Print(out.String())
+	os.Stdout.Sync()
+}
+
+// closeMenu clears the menu and either keeps the selected candidate,
+// followed by a space as when it is the only one, or restores the line
+func (e *LineEditor) closeMenu(accept bool) {
+	m := e.menu
+	e.menu = nil
+
+	if accept {
+		match := m.matches[m.selected]
+		line, cursor := insertCompletion(m.ctx, match.text, !match.noSpace)
+		e.buffer = []rune(line)
+		e.cursor = len([]rune(line[:cursor]))
+	} else {
+		e.buffer = m.original
+		e.cursor = m.originalCursor
+	}
+
+	fmt.Print("\r\033[J")
+	e.refresh()
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"unicode"
+)
+
+// maxKillRingSize matches readline's default kill ring length
+const maxKillRingSize = 10
+
+// editorAction records what the previous key did, so consecutive kills are
+// joined into one kill ring entry, Alt+Y only follows a yank and repeated
+// Up, Down and Alt+. keys carry on from where the last one stopped
+type editorAction int
+
+const (
+	actionOther editorAction = iota
+	actionKill
+	actionYank
+	actionHistory
+	actionLastArg
+	actionCtrlX    // Ctrl+X, the prefix of Ctrl+X Ctrl+E
+	actionComplete // Tab, counted to list the candidates on the second one
+)
+
+// KillRing holds killed text for Ctrl+Y and Alt+Y. It is shared by every
+// line so text killed on one prompt can be yanked on the next.
+type KillRing struct {
+	entries []string
+	index   int // entry Ctrl+Y yanks, moved by Alt+Y
+}
+
+var killRing = &KillRing{}
+
+// push stores killed text. When the previous key was also a kill the text
+// is joined to the newest entry instead, before it for backward kills.
+func (k *KillRing) push(text string, joinPrevious bool, backward bool) {
+	if text == "" {
+		return
+	}
+
+	if joinPrevious && len(k.entries) > 0 {
+		last := len(k.entries) - 1
+		if backward {
+			k.entries[last] = text + k.entries[last]
+		} else {
+			k.entries[last] += text
+		}
+	} else {
+		k.entries = append(k.entries, text)
+		if len(k.entries) > maxKillRingSize {
+			k.entries = k.entries[1:]
+		}
+	}
+
+	k.index = len(k.entries) - 1
+}
+
+func (k *KillRing) current() (string, bool) {
+	if len(k.entries) == 0 {
+		return "", false
+	}
+	return k.entries[k.index], true
+}
+
+// rotate moves to the next older entry, wrapping around
+func (k *KillRing) rotate() (string, bool) {
+	if len(k.entries) == 0 {
+		return "", false
+	}
+	k.index = (k.index - 1 + len(k.entries)) % len(k.entries)
+	return k.entries[k.index], true
+}
+
+// handleEmacsKey implements the readline emacs bindings
+func (e *LineEditor) handleEmacsKey(key keyPress) {
+	if key.code == keyControl {
+		switch key.char {
+		case 'a':
+			e.moveTo(0)
+		case 'e':
+			e.moveTo(len(e.buffer))
+		case 'b':
+			e.moveTo(e.previousCharStart())
+		case 'f':
+			e.moveTo(e.nextCharEnd())
+		case 'k':
+			e.kill(e.cursor, len(e.buffer), false)
+		case 'u':
+			e.kill(0, e.cursor, true)
+		case 'w':
+			e.kill(e.previousSpaceWordStart(), e.cursor, true)
+		case 'y':
+			e.yank()
+		case 't':
+			e.transposeChars()
+		case 'l':
+			fmt.Print("\033[H\033[2J") // clear screen and home the cursor
+			e.refresh()
+		case 'x':
+			e.thisAction = actionCtrlX
+		}
+		return
+	}
+
+	if key.code == keyBackspace && key.alt {
+		e.kill(e.previousWordStart(), e.cursor, true)
+		return
+	}
+
+	if key.code != keyRune || !key.alt {
+		return
+	}
+
+	switch key.char {
+	case 'b':
+		e.moveTo(e.previousWordStart())
+	case 'f':
+		e.moveTo(e.nextWordEnd())
+	case 'd':
+		e.kill(e.cursor, e.nextWordEnd(), false)
+	case 'y':
+		e.yankPop()
+	case 'u':
+		e.changeWordCase(unicode.ToUpper, unicode.ToUpper)
+	case 'l':
+		e.changeWordCase(unicode.ToLower, unicode.ToLower)
+	case 'c':
+		e.changeWordCase(unicode.ToUpper, unicode.ToLower)
+	case '.', '_':
+		e.yankLastArg()
+	}
+}
+
+// kill removes buffer[start:end] into the kill ring
+func (e *LineEditor) kill(start, end int, backward bool) {
+	start = max(start, 0)
+	end = min(end, len(e.buffer))
+	if start >= end {
+		e.thisAction = actionKill
+		return
+	}
+
+	killRing.push(string(e.buffer[start:end]), e.lastAction == actionKill, backward)
+	e.deleteRange(start, end)
+	e.thisAction = actionKill
+}
+
+func (e *LineEditor) yank() {
+	text, ok := killRing.current()
+	if !ok {
+		return
+	}
+
+	e.yankStart = e.cursor
+	e.insert([]rune(text))
+	e.thisAction = actionYank
+}
+
+// yankPop replaces the text just yanked with the next older kill
+func (e *LineEditor) yankPop() {
+	if e.lastAction != actionYank {
+		return
+	}
+
+	text, ok := killRing.rotate()
+	if !ok {
+		return
+	}
+
+	yanked := []rune(text)
+	e.buffer = slices.Concat(e.buffer[:e.yankStart], yanked, e.buffer[e.cursor:])
+	e.cursor = e.yankStart + len(yanked)
+	e.refresh()
+	e.thisAction = actionYank
+}
+
+// yankLastArg inserts the last word of the previous command. Repeating it
+// replaces that word with the last word of the command before.
+func (e *LineEditor) yankLastArg() {
+	if e.lastAction == actionLastArg {
+		e.lastArgOffset++
+	} else {
+		e.lastArgOffset = 1
+		e.yankStart = e.cursor
+	}
+	e.thisAction = actionLastArg
+
+	pos := len(HISTORY) - e.lastArgOffset
+	if pos < 0 {
+		e.lastArgOffset--
+		fmt.Print("\a") // ASCII Bell
+		return
+	}
+
+	words := historyWords(HISTORY[pos].Line)
+	lastArg := ""
+	if len(words) > 0 {
+		lastArg = words[len(words)-1]
+	}
+
+	arg := []rune(lastArg)
+	e.buffer = slices.Concat(e.buffer[:e.yankStart], arg, e.buffer[e.cursor:])
+	e.cursor = e.yankStart + len(arg)
+	e.refresh()
+}
+
+// transposeChars swaps the characters around the cursor, or the last two
+// at the end of the line, and moves forward
+func (e *LineEditor) transposeChars() {
+	if len(e.buffer) < 2 || e.cursor == 0 {
+		return
+	}
+
+	pos := e.cursor
+	if pos == len(e.buffer) {
+		pos = previousGraphemeStart(e.buffer, pos)
+	}
+	start := previousGraphemeStart(e.buffer, pos)
+	end := nextGraphemeEnd(e.buffer, pos)
+	if start == pos {
+		return
+	}
+
+	e.buffer = slices.Concat(e.buffer[:start], e.buffer[pos:end], e.buffer[start:pos], e.buffer[end:])
+	e.cursor = end
+	e.refresh()
+}
+
+// changeWordCase applies first to the first letter of the next word and
+// rest to the others, leaving the cursor after the word
+func (e *LineEditor) changeWordCase(first, rest func(rune) rune) {
+	end := e.nextWordEnd()
+	isFirst := true
+
+	for i := e.cursor; i < end; i++ {
+		if !isWordChar(e.buffer[i]) {
+			continue
+		}
+		if isFirst {
+			e.buffer[i] = first(e.buffer[i])
+			isFirst = false
+		} else {
+			e.buffer[i] = rest(e.buffer[i])
+		}
+	}
+
+	e.cursor = end
+	e.refresh()
+}
+
+func isWordChar(char rune) bool {
+	return unicode.IsLetter(char) || unicode.IsDigit(char)
+}
+
+// previousWordStart is where Alt+B lands: the start of the alphanumeric
+// word before the cursor
+func (e *LineEditor) previousWordStart() int {
+	pos := e.cursor
+	for pos > 0 && !isWordChar(e.buffer[pos-1]) {
+		pos--
+	}
+	for pos > 0 && isWordChar(e.buffer[pos-1]) {
+		pos--
+	}
+	return pos
+}
+
+// nextWordEnd is where Alt+F lands: the end of the next alphanumeric word
+func (e *LineEditor) nextWordEnd() int {
+	pos := e.cursor
+	for pos < len(e.buffer) && !isWordChar(e.buffer[pos]) {
+		pos++
+	}
+	for pos < len(e.buffer) && isWordChar(e.buffer[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// previousSpaceWordStart is where Ctrl+W kills back to: words there are
+// separated by whitespace only
+func (e *LineEditor) previousSpaceWordStart() int {
+	pos := e.cursor
+	for pos > 0 && unicode.IsSpace(e.buffer[pos-1]) {
+		pos--
+	}
+	for pos > 0 && !unicode.IsSpace(e.buffer[pos-1]) {
+		pos--
+	}
+	return pos
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// defaultEditor is used when neither VISUAL nor EDITOR is set
+const defaultEditor = "vi"
+
+// lineEditorCommand is the editor for the line being typed: $VISUAL, then
+// $EDITOR
+func lineEditorCommand() string {
+	if editor := getVar("VISUAL"); editor != "" {
+		return editor
+	}
+	if editor := getVar("EDITOR"); editor != "" {
+		return editor
+	}
+	return defaultEditor
+}
+
+// editInEditor writes text to a temporary file, opens it in editor and
+// returns the saved contents without the trailing newline. The terminal
+// must be in its normal mode while the editor runs.
+func editInEditor(text string, editor string) (string, error) {
+	file, err := os.CreateTemp("", "myshell-edit-*.sh")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.WriteString(text + "\n"); err != nil {
+		file.Close()
+		return "", fmt.Errorf("could not write temporary file: %w", err)
+	}
+	file.Close()
+
+	// EDITOR may carry its own arguments, such as "code --wait"
+	editorArgs := strings.Fields(editor)
+	command := exec.Command(editorArgs[0], append(editorArgs[1:], file.Name())...)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	if err := command.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w", editor, err)
+	}
+
+	edited, err := os.ReadFile(file.Name())
+	if err != nil {
+		return "", fmt.Errorf("could not read temporary file: %w", err)
+	}
+
+	return strings.TrimRight(string(edited), "\n"), nil
+}
+
+// editBufferInEditor opens the line in $EDITOR and submits the result
+func (e *LineEditor) editBufferInEditor() (bool, error) {
+	var edited string
+	var err error
+	e.withTerminalRestored(func() {
+		fmt.Print("\r\n")
+		edited, err = editInEditor(string(e.buffer), lineEditorCommand())
+	})
+	if err != nil {
+		fmt.Printf("\r\n%v\r\n", err)
+		e.refresh()
+		return false, nil
+	}
+
+	e.setBuffer(edited)
+	return true, nil
+}
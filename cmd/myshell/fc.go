@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const fcUsage = "fc: usage: fc [-e ename] [-lnr] [first] [last] or fc -s [pat=rep] [command]"
+
+// fcListDefault is how many commands `fc -l` lists without a range
+const fcListDefault = 16
+
+type fcOptions struct {
+	list          bool
+	noNumbers     bool
+	reverse       bool
+	reexecute     bool
+	editor        string
+	substitutions []string // old=new pairs for -s
+	operands      []string // first and last
+}
+
+func handleFcCmd(args []string) {
+	opts, err := parseFcOptions(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fc: %v\n", err)
+		fmt.Fprintln(os.Stderr, fcUsage)
+		lastExitStatus = 2
+		return
+	}
+
+	// The fc command itself is not one of the commands it works on
+	entries := HISTORY
+	if currentLineRecorded && len(entries) > 0 {
+		entries = entries[:len(entries)-1]
+	}
+
+	switch {
+	case opts.reexecute:
+		err = fcReexecute(entries, opts)
+	case opts.list:
+		err = fcList(entries, opts)
+	default:
+		err = fcEdit(entries, opts)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fc: %v\n", err)
+		lastExitStatus = 1
+	}
+}
+
+func parseFcOptions(args []string) (fcOptions, error) {
+	var opts fcOptions
+
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		// Negative numbers are history offsets, not options
+		if !strings.HasPrefix(arg, "-") || len(arg) == 1 || isDigit(arg[1]) {
+			break
+		}
+
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'l':
+				opts.list = true
+			case 'n':
+				opts.noNumbers = true
+			case 'r':
+				opts.reverse = true
+			case 's':
+				opts.reexecute = true
+			case 'e':
+				i++
+				if i >= len(args) {
+					return opts, fmt.Errorf("-e: option requires an argument")
+				}
+				opts.editor = args[i]
+				// fc -e - re-executes without editing, like fc -s
+				if opts.editor == "-" {
+					opts.reexecute = true
+				}
+			default:
+				return opts, fmt.Errorf("-%c: invalid option", flag)
+			}
+		}
+	}
+
+	for ; i < len(args); i++ {
+		if opts.reexecute && strings.Contains(args[i], "=") && len(opts.operands) == 0 {
+			opts.substitutions = append(opts.substitutions, args[i])
+			continue
+		}
+		opts.operands = append(opts.operands, args[i])
+	}
+
+	if len(opts.operands) > 2 || (opts.reexecute && len(opts.operands) > 1) {
+		return opts, fmt.Errorf("too many arguments")
+	}
+	return opts, nil
+}
+
+// fcEventIndex finds the entry a first or last operand refers to: a
+// history number, a negative offset from the newest entry, or the newest
+// entry starting with a string
+func fcEventIndex(entries []HistoryEntry, spec string, clamp bool) (int, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		index := n - 1
+		if n < 0 {
+			index = len(entries) + n
+		}
+
+		if clamp {
+			index = max(0, min(index, len(entries)-1))
+		}
+		if index < 0 || index >= len(entries) {
+			return 0, fmt.Errorf("history specification out of range")
+		}
+		return index, nil
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.HasPrefix(entries[i].Line, spec) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: no command found", spec)
+}
+
+// fcRange resolves the first and last operands. Without operands the
+// range is the last command, or the last 16 for -l.
+func fcRange(entries []HistoryEntry, opts fcOptions) (int, int, error) {
+	if len(entries) == 0 {
+		return 0, 0, fmt.Errorf("no command found")
+	}
+
+	first, last := "-1", ""
+	if opts.list {
+		first = strconv.Itoa(-fcListDefault)
+	}
+	if len(opts.operands) > 0 {
+		first = opts.operands[0]
+	}
+	if len(opts.operands) > 1 {
+		last = opts.operands[1]
+	}
+	if last == "" {
+		last = first
+		if opts.list {
+			last = "-1"
+		}
+	}
+
+	start, err := fcEventIndex(entries, first, opts.list)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := fcEventIndex(entries, last, opts.list)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// fcSelect returns the indexes from start to end, which may run backwards
+func fcSelect(start, end int, reverse bool) []int {
+	if start > end {
+		start, end = end, start
+		reverse = !reverse
+	}
+
+	indexes := make([]int, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		indexes = append(indexes, i)
+	}
+	if reverse {
+		slices.Reverse(indexes)
+	}
+	return indexes
+}
+
+func fcList(entries []HistoryEntry, opts fcOptions) error {
+	start, end, err := fcRange(entries, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range fcSelect(start, end, opts.reverse) {
+		if opts.noNumbers {
+			fmt.Printf("\t %s\n", entries[i].Line)
+		} else {
+			fmt.Printf("%d\t %s\n", i+1, entries[i].Line)
+		}
+	}
+	return nil
+}
+
+// fcEdit opens the range in the editor and runs what was saved
+func fcEdit(entries []HistoryEntry, opts fcOptions) error {
+	start, end, err := fcRange(entries, opts)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, i := range fcSelect(start, end, opts.reverse) {
+		lines = append(lines, entries[i].Line)
+	}
+
+	editor := opts.editor
+	if editor == "" {
+		editor = getVar("FCEDIT")
+	}
+	if editor == "" {
+		editor = lineEditorCommand()
+	}
+
+	edited, err := editInEditor(strings.Join(lines, "\n"), editor)
+	if err != nil {
+		return err
+	}
+
+	fcRun(edited)
+	return nil
+}
+
+// fcReexecute runs a command again after replacing each old=new
+func fcReexecute(entries []HistoryEntry, opts fcOptions) error {
+	start, _, err := fcRange(entries, opts)
+	if err != nil {
+		return err
+	}
+
+	line := entries[start].Line
+	for _, substitution := range opts.substitutions {
+		old, replacement, _ := strings.Cut(substitution, "=")
+		if old != "" {
+			line = strings.ReplaceAll(line, old, replacement)
+		}
+	}
+
+	fcRun(line)
+	return nil
+}
+
+// fcRun shows and runs the commands fc produced. They take the place of
+// the fc command in the history.
+func fcRun(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	fmt.Println(text)
+
+	removeCurrentLine()
+	entry := newHistoryEntry(text)
+	addCmdToHistory(entry)
+	currentLineRecorded = true
+
+	runCommandList(text)
+	finishHistoryEntry(entry, lastExitStatus)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// functionKeyword may start a definition, as in `function name { ...; }`
+const functionKeyword = "function"
+
+// maxFunctionDepth stops a function that calls itself without end
+const maxFunctionDepth = 1000
+
+// shellFunctions holds the body of each defined function as typed: a
+// group, with any redirections after it. It is parsed on every call.
+var shellFunctions = map[string]string{}
+
+// positionalParams are $1, $2, ... of the function being run
+var positionalParams []string
+
+var functionDepth = 0
+
+// parseFunctionDefinition parses `name() body` and `function name [()] body`,
+// where body is a ( ... ) or { ...; } group. ok is false when input does
+// not define a function.
+func parseFunctionDefinition(input string) (parsedCmd ParsedCommand, ok bool) {
+	rest := input
+	hasKeyword := isKeywordAt(input, 0, functionKeyword)
+	if hasKeyword {
+		rest = strings.TrimLeft(input[len(functionKeyword):], " ")
+	}
+
+	nameEnd := strings.IndexAny(rest, " (")
+	if nameEnd == -1 {
+		nameEnd = len(rest)
+	}
+	name := rest[:nameEnd]
+	rest = strings.TrimLeft(rest[nameEnd:], " ")
+
+	hasParens := false
+	if inner, found := strings.CutPrefix(rest, "("); found {
+		inner = strings.TrimLeft(inner, " ")
+		if hasParens = strings.HasPrefix(inner, ")"); hasParens {
+			rest = strings.TrimLeft(inner[1:], " ")
+		}
+	}
+	if !hasKeyword && (!hasParens || !isValidFunctionName(name)) {
+		return ParsedCommand{}, false
+	}
+
+	if name == "" {
+		fmt.Println("syntax error near unexpected token `newline'")
+		return ParsedCommand{}, true
+	}
+	if !isValidFunctionName(name) {
+		fmt.Printf("`%s': not a valid identifier\n", name)
+		return ParsedCommand{}, true
+	}
+	if rest == "" || (rest[0] != subshellOpen && !(rest[0] == groupOpen && isGroupOpen(rest, 0))) {
+		token := "newline"
+		if fields := strings.Fields(rest); len(fields) > 0 {
+			token = fields[0]
+		}
+		fmt.Printf("syntax error near unexpected token `%s'\n", token)
+		return ParsedCommand{}, true
+	}
+
+	// Check the body now, so a broken definition is not stored
+	if body := parseGroup(rest); body.Group == NoGroup {
+		return ParsedCommand{}, true
+	}
+
+	return ParsedCommand{
+		Group:     FunctionDefinition,
+		GroupBody: rest,
+		FuncName:  name,
+	}, true
+}
+
+// isValidFunctionName accepts the names bash does, which unlike variable
+// names may contain characters such as - and .
+func isValidFunctionName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \t\n'\"`$\\|&;<>(){}=")
+}
+
+func isFunction(name string) bool {
+	_, ok := shellFunctions[name]
+	return ok
+}
+
+// runsInShell reports whether name is run by the shell itself rather than
+// as an external command
+func runsInShell(name string) bool {
+	return slices.Contains(builtInCommands, name) || isFunction(name)
+}
+
+// runFunction runs the body of a function in the current shell, with args
+// as its positional parameters
+func runFunction(name string, args []string) {
+	if functionDepth >= maxFunctionDepth {
+		fmt.Fprintf(os.Stderr, "%s: maximum function nesting level exceeded (%d)\n", name, maxFunctionDepth)
+		lastExitStatus = 1
+		return
+	}
+
+	savedParams := positionalParams
+	positionalParams = args
+	functionDepth++
+	defer func() {
+		positionalParams = savedParams
+		functionDepth--
+	}()
+
+	body := parseInput(shellFunctions[name])
+	handleCommand(&body)
+}
@@ -0,0 +1,103 @@
+package main
+
+// globMatch reports whether text matches the shell pattern. Unlike
+// filepath.Match, * and ? also match '/', as in case patterns and
+// HISTIGNORE.
+func globMatch(pattern, text string) bool {
+	p := []rune(pattern)
+	t := []rune(text)
+
+	// Backtrack to the last * when a later part of the pattern fails
+	starP, starT := -1, 0
+	pi, ti := 0, 0
+
+	for ti < len(t) {
+		if pi < len(p) {
+			switch p[pi] {
+			case '*':
+				starP, starT = pi, ti
+				pi++
+				continue
+			case '?':
+				pi++
+				ti++
+				continue
+			case '[':
+				if end, ok := matchBracket(p, pi, t[ti]); end > 0 {
+					if ok {
+						pi = end
+						ti++
+						continue
+					}
+				} else if t[ti] == '[' {
+					// An unclosed [ is an ordinary character
+					pi++
+					ti++
+					continue
+				}
+			case '\\':
+				if pi+1 < len(p) && p[pi+1] == t[ti] {
+					pi += 2
+					ti++
+					continue
+				}
+			default:
+				if p[pi] == t[ti] {
+					pi++
+					ti++
+					continue
+				}
+			}
+		}
+
+		if starP < 0 {
+			return false
+		}
+		starT++
+		pi, ti = starP+1, starT
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// matchBracket matches char against the bracket expression starting at
+// p[start]. It returns the index after the closing ']', or 0 when the
+// expression is not closed.
+func matchBracket(p []rune, start int, char rune) (int, bool) {
+	i := start + 1
+	negate := false
+	if i < len(p) && (p[i] == '!' || p[i] == '^') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	first := true
+	for i < len(p) && (p[i] != ']' || first) {
+		first = false
+
+		low := p[i]
+		if low == '\\' && i+1 < len(p) {
+			i++
+			low = p[i]
+		}
+		high := low
+		if i+2 < len(p) && p[i+1] == '-' && p[i+2] != ']' {
+			high = p[i+2]
+			i += 2
+		}
+
+		if char >= low && char <= high {
+			matched = true
+		}
+		i++
+	}
+
+	if i >= len(p) {
+		return 0, false
+	}
+	return i + 1, matched != negate
+}
@@ -1,144 +1,373 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
-var HISTORY []ParsedCommand
+// HistoryEntry is one line of history, kept exactly as it was typed
+// including quotes, operators and embedded newlines
+type HistoryEntry struct {
+	Line       string
+	Time       time.Time     // when the line was entered
+	Duration   time.Duration // how long it ran
+	Cwd        string        // working directory it ran in
+	ExitStatus int
+	Session    string // sessionID of the shell that ran it
 
+	saved bool // already in the history file
+}
+
+var HISTORY []HistoryEntry
+
+// knownHistory holds the key of every entry this shell has had, so merging
+// the history file only adds entries from other sessions
+var knownHistory = make(map[string]bool)
+
+func (entry HistoryEntry) key() string {
+	return fmt.Sprintf("%d|%s|%s", entry.Time.Unix(), entry.Session, entry.Line)
+}
+
+// sessionID tells apart the entries of shells sharing a history file
+var sessionID = fmt.Sprintf("%d.%s", os.Getpid(), strconv.FormatInt(time.Now().Unix(), 36))
+
+// MAX_HISTORY is the number of entries kept when HISTSIZE is not set
 const MAX_HISTORY = 100
 
 var lastCommandPos int = -1
 
-func addCmdToHistory(cmd ParsedCommand) {
-	if len(HISTORY) >= MAX_HISTORY {
-		HISTORY = HISTORY[1:] // Remove the oldest command
-	}
-	HISTORY = append(HISTORY, cmd)
+// currentLineRecorded is set while the line being run is the newest
+// history entry, which `history -s` and `history -p` replace
+var currentLineRecorded bool
+
+func addCmdToHistory(entry HistoryEntry) {
+	entry.Line = redactHistory(entry.Line)
+	knownHistory[entry.key()] = true
+	HISTORY = append(HISTORY, entry)
+	HISTORY = lastEntries(HISTORY, historySize()) // Remove the oldest commands
 
 	lastCommandPos = len(HISTORY)
 }
 
-func displayCmdHistory(args []string) {
-	limit := len(HISTORY)
-	if len(args) > 0 {
-		parsedLimit, _ := strconv.ParseInt(args[0], 10, 64)
-		limit = int(parsedLimit)
+func newHistoryEntry(line string) HistoryEntry {
+	cwd, _ := os.Getwd()
+	return HistoryEntry{
+		Line:    line,
+		Time:    time.Now(),
+		Cwd:     cwd,
+		Session: sessionID,
 	}
+}
+
+func clearHistory() {
+	HISTORY = nil
+	lastCommandPos = 0
+	currentLineRecorded = false
+}
 
-	for i := len(HISTORY) - limit; i < len(HISTORY); i++ {
-		cmd := HISTORY[i]
-		fmt.Printf("\t%d  %s ", i+1, cmd.Cmd)
-		for _, arg := range cmd.Args {
-			fmt.Printf("%s ", arg)
+// deleteHistory removes the entry at a history position, or the entries
+// of an inclusive start-end range. Negative positions count back from the
+// end, so -1 is the newest entry.
+func deleteHistory(spec string) error {
+	startText, endText := spec, spec
+	for i := 1; i < len(spec); i++ {
+		if spec[i] == '-' && isDigit(spec[i-1]) {
+			startText, endText = spec[:i], spec[i+1:]
+			break
 		}
-		fmt.Println()
 	}
-}
 
-func getPreviousCommand() ParsedCommand {
-	if lastCommandPos <= 0 || lastCommandPos > len(HISTORY) {
-		return ParsedCommand{}
+	start, err := historyOffset(startText)
+	if err != nil {
+		return err
+	}
+	end, err := historyOffset(endText)
+	if err != nil {
+		return err
+	}
+	if start > end {
+		return fmt.Errorf("%s: history position out of range", spec)
 	}
 
-	lastCommandPos--
-	return HISTORY[lastCommandPos]
+	HISTORY = slices.Delete(HISTORY, start, end+1)
+	lastCommandPos = len(HISTORY)
+	currentLineRecorded = false
+	return nil
 }
 
-func getNextCommand() ParsedCommand {
-	if lastCommandPos >= len(HISTORY)-1 {
-		return ParsedCommand{}
+// historyOffset converts a history position to an index into HISTORY
+func historyOffset(text string) (int, error) {
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("%s: history position out of range", text)
+	}
+
+	index := n - 1
+	if n < 0 {
+		index = len(HISTORY) + n
+	}
+	if index < 0 || index >= len(HISTORY) {
+		return 0, fmt.Errorf("%s: history position out of range", text)
 	}
+	return index, nil
+}
 
-	lastCommandPos++
-	return HISTORY[lastCommandPos]
+// removeCurrentLine drops the `history -s` or `history -p` command itself
+// from the history, as bash does
+func removeCurrentLine() {
+	if currentLineRecorded && len(HISTORY) > 0 {
+		HISTORY = HISTORY[:len(HISTORY)-1]
+		lastCommandPos = len(HISTORY)
+	}
+	currentLineRecorded = false
 }
 
-func addContentsToHistory(fileName string) {
-	historyFile, err := os.Open(fileName)
-	if err != nil {
-		fmt.Printf("Error opening history file: %s\n", err)
-		return
+// storeHistory adds args as one entry without running them
+func storeHistory(args []string) {
+	removeCurrentLine()
+	if len(args) > 0 {
+		addCmdToHistory(newHistoryEntry(strings.Join(args, " ")))
 	}
-	defer historyFile.Close()
+}
 
-	scanner := bufio.NewScanner(historyFile)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+// printHistoryExpansion prints the history expansion of each argument
+func printHistoryExpansion(args []string) {
+	removeCurrentLine()
+	for _, arg := range args {
+		expansion, err := expandHistory(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history: %v\n", err)
+			lastExitStatus = 1
+			return
 		}
+		fmt.Println(expansion.line)
+	}
+}
 
-		// Parse the line into command and arguments
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
-			continue
+// finishHistoryEntry records how the command of entry went once it is done
+func finishHistoryEntry(entry HistoryEntry, exitStatus int) {
+	for i := len(HISTORY) - 1; i >= 0; i-- {
+		if HISTORY[i].Session == entry.Session && HISTORY[i].Time.Equal(entry.Time) {
+			HISTORY[i].Duration = time.Since(entry.Time)
+			HISTORY[i].ExitStatus = exitStatus
+			return
 		}
+	}
+}
+
+const historyUsage = "history: usage: history [-c] [-d offset] [n] or history -anrw [filename] or history -ps arg [arg...] or history stats [n] or history export|import [--format=json|csv|histfile] [filename]"
 
-		cmd := ParsedCommand{
-			Cmd:  parts[0],
-			Args: parts[1:],
+var errInvalidHistoryOption = errors.New("invalid option")
+
+// historyFilter selects the entries `history` lists
+type historyFilter struct {
+	limit  int // only the last limit matches, -1 for all
+	cwd    string
+	failed bool
+	since  time.Time
+}
+
+func (f historyFilter) matches(entry HistoryEntry) bool {
+	if f.cwd != "" && entry.Cwd != f.cwd {
+		return false
+	}
+	if f.failed && entry.ExitStatus == 0 {
+		return false
+	}
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	return true
+}
+
+func parseHistoryFilter(args []string) (historyFilter, error) {
+	filter := historyFilter{limit: -1}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := strings.Cut(arg, "=")
+
+		switch name {
+		case "--failed":
+			filter.failed = true
+
+		case "--cwd":
+			// With no directory, --cwd means the current one
+			if !hasValue {
+				value, _ = os.Getwd()
+			}
+			filter.cwd = value
+
+		case "--since":
+			if !hasValue {
+				i++
+				if i >= len(args) {
+					return filter, fmt.Errorf("--since: option requires an argument")
+				}
+				value = args[i]
+			}
+			since, err := parseSince(value)
+			if err != nil {
+				return filter, err
+			}
+			filter.since = since
+
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return filter, fmt.Errorf("%s: %w", arg, errInvalidHistoryOption)
+			}
+			if filter.limit >= 0 {
+				return filter, fmt.Errorf("too many arguments")
+			}
+			parsedLimit, err := strconv.Atoi(arg)
+			if err != nil {
+				return filter, fmt.Errorf("%s: numeric argument required", arg)
+			}
+			filter.limit = parsedLimit
 		}
+	}
+
+	return filter, nil
+}
+
+// parseSince accepts a duration back from now such as 90m or 2h, a date,
+// a date and time, or a time today
+func parseSince(value string) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
 
-		addCmdToHistory(cmd)
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if since, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return since, nil
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Error reading history file: %v\n", err)
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if clock, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			now := time.Now()
+			return time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, time.Local), nil
+		}
 	}
+
+	return time.Time{}, fmt.Errorf("--since: %s: invalid time", value)
 }
 
-func writeHistoryToFile(fileName string, append bool) {
-	if fileName == "" {
-		fmt.Println("No history file set")
+func displayCmdHistory(args []string) {
+	filter, err := parseHistoryFilter(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history: %v\n", err)
+		lastExitStatus = 1
+		if errors.Is(err, errInvalidHistoryOption) {
+			fmt.Fprintln(os.Stderr, historyUsage)
+			lastExitStatus = 2
+		}
 		return
 	}
 
-	var historyFile *os.File
-	if append {
-		historyFile, _ = os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	} else {
-		historyFile, _ = os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	var matches []int
+	for i, entry := range HISTORY {
+		if filter.matches(entry) {
+			matches = append(matches, i)
+		}
+	}
+	if filter.limit >= 0 && filter.limit < len(matches) {
+		matches = matches[len(matches)-filter.limit:]
 	}
 
-	defer historyFile.Close()
+	// HISTTIMEFORMAT, as in bash, puts the time before each line
+	timeFormat, showTime := lookupVar("HISTTIMEFORMAT")
 
-	for _, cmd := range HISTORY {
-		line := cmd.Cmd
-		if len(cmd.Args) > 0 {
-			line += " " + strings.Join(cmd.Args, " ")
+	for _, i := range matches {
+		entry := HISTORY[i]
+		timestamp := ""
+		if showTime && !entry.Time.IsZero() {
+			timestamp = formatStrftime(entry.Time, timeFormat)
 		}
+		fmt.Printf("\t%d  %s%s\n", i+1, timestamp, entry.Line)
+	}
+}
 
-		_, err := historyFile.WriteString(line + "\n")
-		if err != nil {
-			fmt.Printf("Error writing to history file: %s\n", err)
-			historyFile.Close()
-			return
+// getPreviousCommand walks back to the next older entry that starts with
+// prefix and differs from current
+func getPreviousCommand(prefix string, current string) (string, bool) {
+	for pos := min(lastCommandPos, len(HISTORY)) - 1; pos >= 0; pos-- {
+		line := HISTORY[pos].Line
+		if strings.HasPrefix(line, prefix) && line != current {
+			lastCommandPos = pos
+			return line, true
 		}
 	}
 
-	// clear HISTORY
-	HISTORY = []ParsedCommand{}
+	return "", false
 }
 
-func loadHistory() {
-	fileName := os.Getenv("HISTFILE")
-	if fileName == "" {
-		return
+// getNextCommand walks forward to the next newer entry that starts with
+// prefix and differs from current. Past the newest entry it returns
+// false, leaving the position after the end of the history.
+func getNextCommand(prefix string, current string) (string, bool) {
+	for pos := max(lastCommandPos, -1) + 1; pos < len(HISTORY); pos++ {
+		line := HISTORY[pos].Line
+		if strings.HasPrefix(line, prefix) && line != current {
+			lastCommandPos = pos
+			return line, true
+		}
 	}
 
-	addContentsToHistory(fileName)
+	lastCommandPos = len(HISTORY)
+	return "", false
 }
 
-func saveHistoryOnExit() {
-	fileName := os.Getenv("HISTFILE")
-	if fileName == "" {
-		return
+// historyWords splits a history line into words on unquoted whitespace,
+// keeping quotes and backslashes as typed
+func historyWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	var quote rune
+	inWord := false
+	escaped := false
+
+	for _, char := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			}
+		case char == '\'' || char == '"':
+			quote = char
+		case char == ' ' || char == '\t' || char == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		}
+
+		word.WriteRune(char)
+		inWord = true
 	}
 
-	writeHistoryToFile(fileName, false)
-}
\ No newline at end of file
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// lastEntries returns the newest size entries, or all of them when size
+// is negative
+func lastEntries(entries []HistoryEntry, size int) []HistoryEntry {
+	if size < 0 || len(entries) <= size {
+		return entries
+	}
+	return entries[len(entries)-size:]
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// historyDelimiters end a !string event and the words of a history line
+const historyDelimiters = " \t\n;&|()<>\"'"
+
+var (
+	// lastHistorySubst is repeated by :& and used when :s has no old text
+	lastHistorySubst struct{ old, new string }
+	// lastHistorySearch is the string of the last !?string? event, for %
+	lastHistorySearch string
+)
+
+// historyExpansion is the result of expanding one input line
+type historyExpansion struct {
+	line      string
+	expanded  bool // whether any expansion took place
+	printOnly bool // set by :p, the line is shown but not run
+}
+
+// expandHistory applies csh-style history expansion to line: events such
+// as !!, !n, !-n, !string and !?string?, the ^old^new quick substitution,
+// word designators and modifiers. Nothing inside single quotes or after a
+// backslash is expanded.
+func expandHistory(line string) (historyExpansion, error) {
+	result := historyExpansion{line: line}
+	if !isOptionSet("histexpand") || !strings.ContainsAny(line, "!^") {
+		return result, nil
+	}
+
+	var out strings.Builder
+	i := 0
+
+	// ^old^new^ at the start of a line is short for !!:s/old/new/
+	if strings.HasPrefix(line, "^") {
+		previous, err := historyEvent(-1, "^")
+		if err != nil {
+			return result, err
+		}
+
+		old, end := readHistoryDelimited(line, 1, '^')
+		replacement, end := readHistoryDelimited(line, end, '^')
+		text, err := substituteHistory(previous, old, replacement, false)
+		if err != nil {
+			return result, err
+		}
+
+		out.WriteString(text)
+		i = end
+		result.expanded = true
+	}
+
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
+
+	for i < len(line) {
+		char := line[i]
+
+		switch {
+		case char == backslash && !isInSingleQuotes && i+1 < len(line):
+			out.WriteString(line[i : i+2])
+			i += 2
+			continue
+		case char == singleQuote && !isInDoubleQuotes:
+			isInSingleQuotes = !isInSingleQuotes
+		case char == doubleQuote && !isInSingleQuotes:
+			isInDoubleQuotes = !isInDoubleQuotes
+		case char == '!' && !isInSingleQuotes && startsHistoryEvent(line, i):
+			text, end, printOnly, err := expandHistoryEvent(line, i)
+			if err != nil {
+				return result, err
+			}
+
+			out.WriteString(text)
+			i = end
+			result.expanded = true
+			result.printOnly = result.printOnly || printOnly
+			continue
+		}
+
+		out.WriteByte(char)
+		i++
+	}
+
+	result.line = out.String()
+	return result, nil
+}
+
+// startsHistoryEvent reports whether the ! at pos begins an expansion. As
+// in bash, a ! before a blank, =, an operator or a quote, or at the end of
+// the line, is kept, and so are $! and ${!name}.
+func startsHistoryEvent(line string, pos int) bool {
+	if pos+1 >= len(line) || strings.IndexByte(historyDelimiters+"=", line[pos+1]) >= 0 {
+		return false
+	}
+	if strings.HasSuffix(line[:pos], "$") || strings.HasSuffix(line[:pos], "${") {
+		return false
+	}
+	return true
+}
+
+// expandHistoryEvent expands the event, word designator and modifiers
+// starting with the ! at pos, and returns where the expansion ends
+func expandHistoryEvent(line string, pos int) (string, int, bool, error) {
+	i := pos + 1
+	var event string
+	var err error
+
+	switch {
+	case line[i] == '!':
+		event, err = historyEvent(-1, "!!")
+		i++
+
+	case line[i] == '#':
+		// !# is the line typed so far
+		event = line[:pos]
+		i++
+
+	case isDigit(line[i]) || (line[i] == '-' && i+1 < len(line) && isDigit(line[i+1])):
+		end := i + 1
+		for end < len(line) && isDigit(line[end]) {
+			end++
+		}
+		// History numbers, as shown by `history`, start at 1
+		n, _ := strconv.Atoi(line[i:end])
+		switch {
+		case n < 0:
+			event, err = historyEvent(n, line[pos:end])
+		case n > 0:
+			event, err = historyEvent(n-1, line[pos:end])
+		default:
+			err = fmt.Errorf("%s: event not found", line[pos:end])
+		}
+		i = end
+
+	case line[i] == '?':
+		search, end := readHistoryDelimited(line, i+1, '?')
+		if newline := strings.IndexByte(search, '\n'); newline >= 0 {
+			search = search[:newline]
+			end = i + 1 + newline
+		}
+		event, err = searchHistoryEvent(search, true, line[pos:end])
+		lastHistorySearch = search
+		i = end
+
+	case strings.IndexByte(":^$*%", line[i]) >= 0:
+		// !$, !^, !* and !:n are words of the previous command
+		event, err = historyEvent(-1, line[pos:i+1])
+
+	default:
+		end := i
+		for end < len(line) && strings.IndexByte(historyDelimiters+":", line[end]) < 0 {
+			end++
+		}
+		event, err = searchHistoryEvent(line[i:end], false, line[pos:end])
+		i = end
+	}
+
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	text, i, err := selectHistoryWords(line, pos, i, event)
+	if err != nil {
+		return "", 0, false, err
+	}
+
+	return applyHistoryModifiers(line, i, text)
+}
+
+// historyEvent returns the entry at index, where a negative index counts
+// back from the newest entry
+func historyEvent(index int, text string) (string, error) {
+	if index < 0 {
+		index += len(HISTORY)
+	}
+	if index < 0 || index >= len(HISTORY) {
+		return "", fmt.Errorf("%s: event not found", text)
+	}
+	return HISTORY[index].Line, nil
+}
+
+// searchHistoryEvent finds the newest entry starting with search, or
+// containing it when anywhere is set
+func searchHistoryEvent(search string, anywhere bool, text string) (string, error) {
+	for i := len(HISTORY) - 1; i >= 0; i-- {
+		line := HISTORY[i].Line
+		if (anywhere && strings.Contains(line, search)) || (!anywhere && strings.HasPrefix(line, search)) {
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("%s: event not found", text)
+}
+
+// selectHistoryWords applies the word designator at pos, if there is one,
+// to the event line. eventStart is where the ! is, for error messages.
+func selectHistoryWords(line string, eventStart, pos int, event string) (string, int, error) {
+	if pos >= len(line) {
+		return event, pos, nil
+	}
+
+	start := pos
+	switch {
+	case line[pos] == ':' && pos+1 < len(line) && strings.IndexByte("0123456789^$*-%", line[pos+1]) >= 0:
+		start = pos + 1
+	case strings.IndexByte("^$*%", line[pos]) >= 0:
+		start = pos
+	default:
+		return event, pos, nil
+	}
+
+	words := historyWords(event)
+	last := len(words) - 1
+	i := start
+
+	parseIndex := func() (int, bool) {
+		if i >= len(line) {
+			return 0, false
+		}
+		switch line[i] {
+		case '^':
+			i++
+			return 1, true
+		case '$':
+			i++
+			return last, true
+		case '%':
+			i++
+			for n, word := range words {
+				if lastHistorySearch != "" && strings.Contains(word, lastHistorySearch) {
+					return n, true
+				}
+			}
+			return -1, true
+		}
+
+		end := i
+		for end < len(line) && isDigit(line[end]) {
+			end++
+		}
+		if end == i {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(line[i:end])
+		i = end
+		return n, true
+	}
+
+	var first, final int
+	if line[i] == '*' {
+		// * is every argument, which may be none
+		i++
+		if last < 1 {
+			return "", i, nil
+		}
+		first, final = 1, last
+	} else {
+		var ok bool
+		if line[i] == '-' {
+			first = 0
+		} else if first, ok = parseIndex(); !ok {
+			return "", 0, fmt.Errorf("%s: bad word specifier", line[eventStart:i])
+		}
+		final = first
+
+		if i < len(line) && line[i] == '*' {
+			i++
+			final = last
+		} else if i < len(line) && line[i] == '-' {
+			i++
+			if final, ok = parseIndex(); !ok {
+				final = last - 1 // x- leaves out the last word
+			}
+		}
+	}
+
+	if first < 0 || final > last || first > final {
+		return "", 0, fmt.Errorf("%s: bad word specifier", line[eventStart:i])
+	}
+	return strings.Join(words[first:final+1], " "), i, nil
+}
+
+// applyHistoryModifiers applies the :h, :t, :r, :e, :s, :&, :p and :q
+// modifiers at pos to text
+func applyHistoryModifiers(line string, pos int, text string) (string, int, bool, error) {
+	printOnly := false
+	i := pos
+
+	for i+1 < len(line) && line[i] == ':' {
+		modifier := line[i+1]
+		global := false
+		if modifier == 'g' && i+2 < len(line) {
+			global = true
+			i++
+			modifier = line[i+1]
+		}
+		i += 2
+
+		switch modifier {
+		case 'h':
+			if slash := strings.LastIndexByte(text, '/'); slash > 0 {
+				text = text[:slash]
+			} else if slash == 0 {
+				text = "/"
+			}
+		case 't':
+			text = text[strings.LastIndexByte(text, '/')+1:]
+		case 'r':
+			if dot := strings.LastIndexByte(text, '.'); dot > strings.LastIndexByte(text, '/') {
+				text = text[:dot]
+			}
+		case 'e':
+			if dot := strings.LastIndexByte(text, '.'); dot > strings.LastIndexByte(text, '/') {
+				text = text[dot:]
+			} else {
+				text = ""
+			}
+		case 'p':
+			printOnly = true
+		case 'q':
+			text = shellQuote(text)
+		case 's':
+			if i >= len(line) {
+				return "", 0, false, fmt.Errorf("%s: substitution failed", line[pos:i])
+			}
+			delimiter := line[i]
+			var old, replacement string
+			old, i = readHistoryDelimited(line, i+1, delimiter)
+			replacement, i = readHistoryDelimited(line, i, delimiter)
+
+			var err error
+			if text, err = substituteHistory(text, old, replacement, global); err != nil {
+				return "", 0, false, err
+			}
+		case '&':
+			var err error
+			if text, err = substituteHistory(text, lastHistorySubst.old, lastHistorySubst.new, global); err != nil {
+				return "", 0, false, err
+			}
+		default:
+			return "", 0, false, fmt.Errorf("%c: unrecognized history modifier", modifier)
+		}
+	}
+
+	return text, i, printOnly, nil
+}
+
+// substituteHistory replaces old with replacement in text, where & in
+// the replacement stands for old. An empty old reuses the previous one.
+func substituteHistory(text, old, replacement string, global bool) (string, error) {
+	if old == "" {
+		old = lastHistorySubst.old
+		if old == "" {
+			old = lastHistorySearch
+		}
+	}
+	if old == "" || !strings.Contains(text, old) {
+		return "", fmt.Errorf(":s/%s/%s/: substitution failed", old, replacement)
+	}
+	lastHistorySubst.old, lastHistorySubst.new = old, replacement
+
+	var expanded strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		switch {
+		case replacement[i] == backslash && i+1 < len(replacement) && replacement[i+1] == '&':
+			expanded.WriteByte('&')
+			i++
+		case replacement[i] == '&':
+			expanded.WriteString(old)
+		default:
+			expanded.WriteByte(replacement[i])
+		}
+	}
+
+	if global {
+		return strings.ReplaceAll(text, old, expanded.String()), nil
+	}
+	return strings.Replace(text, old, expanded.String(), 1), nil
+}
+
+// readHistoryDelimited reads text up to the delimiter, or the end of the
+// line, with a backslash quoting the delimiter. It returns the text and
+// the position after the delimiter.
+func readHistoryDelimited(line string, pos int, delimiter byte) (string, int) {
+	var text strings.Builder
+	i := pos
+	for i < len(line) && line[i] != delimiter {
+		if line[i] == backslash && i+1 < len(line) && line[i+1] == delimiter {
+			i++
+		}
+		text.WriteByte(line[i])
+		i++
+	}
+
+	if i < len(line) {
+		i++ // skip the closing delimiter
+	}
+	return text.String(), i
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyRecord is how an entry is exported to JSON and CSV
+type historyRecord struct {
+	Time       string  `json:"time,omitempty"` // RFC 3339, empty when unknown
+	Duration   float64 `json:"duration"`       // seconds
+	ExitStatus int     `json:"exit_status"`
+	Cwd        string  `json:"cwd,omitempty"`
+	Session    string  `json:"session,omitempty"`
+	Command    string  `json:"command"`
+}
+
+// historyCSVHeader names the CSV columns, in historyRecord's order
+var historyCSVHeader = []string{"time", "duration", "exit_status", "cwd", "session", "command"}
+
+func newHistoryRecord(entry HistoryEntry) historyRecord {
+	record := historyRecord{
+		Duration:   entry.Duration.Seconds(),
+		ExitStatus: entry.ExitStatus,
+		Cwd:        entry.Cwd,
+		Session:    entry.Session,
+		Command:    entry.Line,
+	}
+	if !entry.Time.IsZero() {
+		record.Time = entry.Time.Format(time.RFC3339)
+	}
+	return record
+}
+
+func (record historyRecord) entry() (HistoryEntry, error) {
+	entry := HistoryEntry{
+		Line:       record.Command,
+		Duration:   time.Duration(record.Duration * float64(time.Second)),
+		ExitStatus: record.ExitStatus,
+		Cwd:        record.Cwd,
+		Session:    record.Session,
+	}
+	if record.Time != "" {
+		t, err := time.Parse(time.RFC3339, record.Time)
+		if err != nil {
+			return entry, fmt.Errorf("%s: invalid time", record.Time)
+		}
+		entry.Time = t
+	}
+	return entry, nil
+}
+
+// parseHistoryFormat reads a --format=name or --format name option and an
+// optional file name from the arguments of export and import
+func parseHistoryFormat(args []string) (format string, fileName string, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--format":
+			i++
+			if i >= len(args) {
+				return "", "", fmt.Errorf("--format: option requires an argument")
+			}
+			format = args[i]
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return "", "", fmt.Errorf("%s: %w", arg, errInvalidHistoryOption)
+		case fileName != "":
+			return "", "", fmt.Errorf("too many arguments")
+		default:
+			fileName = arg
+		}
+	}
+
+	switch format {
+	case "", "json", "csv", "histfile":
+		return format, fileName, nil
+	}
+	return "", "", fmt.Errorf("%s: unknown format, expected json, csv or histfile", format)
+}
+
+// handleHistoryExport writes the history to a file, or standard output,
+// as JSON (the default), CSV or in the HISTFILE format
+func handleHistoryExport(args []string) {
+	format, fileName, err := parseHistoryFormat(args)
+	if err != nil {
+		historyFormatError("export", err)
+		return
+	}
+	if format == "" {
+		format = historyFormatOf(fileName, "json")
+	}
+
+	var out io.Writer = os.Stdout
+	if fileName != "" && fileName != "-" {
+		file, err := os.Create(fileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history: export: %v\n", err)
+			lastExitStatus = 1
+			return
+		}
+		defer file.Close()
+		out = file
+	}
+
+	if err := exportHistory(out, format, HISTORY); err != nil {
+		fmt.Fprintf(os.Stderr, "history: export: %v\n", err)
+		lastExitStatus = 1
+	}
+}
+
+func exportHistory(out io.Writer, format string, entries []HistoryEntry) error {
+	switch format {
+	case "csv":
+		writer := csv.NewWriter(out)
+		writer.Write(historyCSVHeader)
+		for _, entry := range entries {
+			record := newHistoryRecord(entry)
+			writer.Write([]string{
+				record.Time,
+				strconv.FormatFloat(record.Duration, 'f', -1, 64),
+				strconv.Itoa(record.ExitStatus),
+				record.Cwd,
+				record.Session,
+				record.Command,
+			})
+		}
+		writer.Flush()
+		return writer.Error()
+
+	case "histfile":
+		return writeHistoryEntries(out, entries)
+	}
+
+	records := make([]historyRecord, 0, len(entries))
+	for _, entry := range entries {
+		records = append(records, newHistoryRecord(entry))
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
+
+// handleHistoryImport adds the entries of an exported or HISTFILE-format
+// file that the history does not have yet. They are saved to HISTFILE
+// like commands typed in this shell.
+func handleHistoryImport(args []string) {
+	format, fileName, err := parseHistoryFormat(args)
+	if err == nil && fileName == "" {
+		err = fmt.Errorf("missing filename")
+	}
+	if err != nil {
+		historyFormatError("import", err)
+		return
+	}
+	if format == "" {
+		format = historyFormatOf(fileName, "histfile")
+	}
+
+	var in io.Reader = os.Stdin
+	if fileName != "-" {
+		file, err := os.Open(fileName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history: import: %v\n", err)
+			lastExitStatus = 1
+			return
+		}
+		defer file.Close()
+		in = file
+	}
+
+	entries, err := importHistory(in, format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "history: import: %s: %v\n", fileName, err)
+		lastExitStatus = 1
+		return
+	}
+
+	// Entries already in the history are skipped, so importing twice is
+	// harmless, but ones removed with history -c or -d come back
+	present := make(map[string]bool, len(HISTORY))
+	for _, entry := range HISTORY {
+		present[entry.key()] = true
+	}
+	var added []HistoryEntry
+	for _, entry := range entries {
+		if !present[entry.key()] {
+			present[entry.key()] = true
+			added = append(added, entry)
+		}
+	}
+	mergeHistoryEntries(added)
+}
+
+// mergeHistoryEntries adds entries to the history in the order they were
+// entered, so older imported ones go before the commands of this session
+func mergeHistoryEntries(entries []HistoryEntry) {
+	for i := range entries {
+		entries[i].Line = redactHistory(entries[i].Line)
+		knownHistory[entries[i].key()] = true
+	}
+
+	HISTORY = append(HISTORY, entries...)
+	slices.SortStableFunc(HISTORY, func(a, b HistoryEntry) int {
+		return a.Time.Compare(b.Time)
+	})
+	HISTORY = lastEntries(HISTORY, historySize())
+
+	lastCommandPos = len(HISTORY)
+}
+
+func importHistory(in io.Reader, format string) ([]HistoryEntry, error) {
+	var records []historyRecord
+
+	switch format {
+	case "histfile":
+		return readHistoryEntries(in)
+
+	case "csv":
+		reader := csv.NewReader(in)
+		reader.FieldsPerRecord = len(historyCSVHeader)
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 && rows[0][0] == historyCSVHeader[0] {
+			rows = rows[1:]
+		}
+
+		for _, row := range rows {
+			duration, err := strconv.ParseFloat(row[1], 64)
+			if err != nil && row[1] != "" {
+				return nil, fmt.Errorf("%s: invalid duration", row[1])
+			}
+			status, err := strconv.Atoi(row[2])
+			if err != nil && row[2] != "" {
+				return nil, fmt.Errorf("%s: invalid exit status", row[2])
+			}
+			records = append(records, historyRecord{
+				Time:       row[0],
+				Duration:   duration,
+				ExitStatus: status,
+				Cwd:        row[3],
+				Session:    row[4],
+				Command:    row[5],
+			})
+		}
+
+	default:
+		if err := json.NewDecoder(in).Decode(&records); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]HistoryEntry, 0, len(records))
+	for _, record := range records {
+		if strings.TrimSpace(record.Command) == "" {
+			continue
+		}
+		entry, err := record.entry()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// historyFormatOf guesses the format from a .json or .csv extension
+func historyFormatOf(fileName string, fallback string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return "json"
+	case ".csv":
+		return "csv"
+	}
+	return fallback
+}
+
+func historyFormatError(subcommand string, err error) {
+	fmt.Fprintf(os.Stderr, "history: %s: %v\n", subcommand, err)
+	fmt.Fprintln(os.Stderr, historyUsage)
+	lastExitStatus = 2
+}
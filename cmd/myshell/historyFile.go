@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openHistoryFile opens a history file and takes an advisory lock on it,
+// shared for reading and exclusive for writing, so shells saving at the
+// same time do not interleave or lose each other's entries
+func openHistoryFile(fileName string, write bool) (*os.File, error) {
+	flags, lock := os.O_RDONLY, unix.LOCK_SH
+	if write {
+		flags, lock = os.O_RDWR|os.O_CREATE, unix.LOCK_EX
+	}
+
+	historyFile, err := os.OpenFile(fileName, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(historyFile.Fd()), lock); err != nil {
+		historyFile.Close()
+		return nil, err
+	}
+	return historyFile, nil
+}
+
+func addContentsToHistory(fileName string) {
+	entries, err := readHistoryFile(fileName)
+	if err != nil {
+		fmt.Printf("Error reading history file: %s\n", err)
+		return
+	}
+
+	for _, entry := range entries {
+		entry.saved = true
+		addCmdToHistory(entry)
+	}
+}
+
+// mergeHistoryFile adds the entries of the file this shell has not seen
+// yet, such as those other sessions appended since it started
+func mergeHistoryFile(fileName string) {
+	entries, err := readHistoryFile(fileName)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error reading history file: %s\n", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !knownHistory[entry.key()] {
+			entry.saved = true
+			addCmdToHistory(entry)
+		}
+	}
+}
+
+func readHistoryFile(fileName string) ([]HistoryEntry, error) {
+	historyFile, err := openHistoryFile(fileName, false)
+	if err != nil {
+		return nil, err
+	}
+	defer historyFile.Close()
+
+	return readHistoryEntries(historyFile)
+}
+
+// readHistoryEntries parses the entries of a history file. A line ending
+// in an odd number of backslashes continues a multi-line entry, and a
+// #timestamp line describes the entry after it.
+func readHistoryEntries(reader io.Reader) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	var text strings.Builder
+	var entry HistoryEntry
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if text.Len() == 0 && isHistoryTimestamp(line) {
+			entry = parseHistoryTimestamp(line)
+			continue
+		}
+		// Trailing backslashes of the entry itself are written doubled, so
+		// only an odd one out marks a continuation
+		content := strings.TrimRight(line, "\\")
+		count := len(line) - len(content)
+		text.WriteString(content + strings.Repeat("\\", count/2))
+		if count%2 == 1 {
+			text.WriteString("\n")
+			continue
+		}
+
+		if strings.TrimSpace(text.String()) != "" {
+			entry.Line = text.String()
+			entries = append(entries, entry)
+		}
+		text.Reset()
+		entry = HistoryEntry{}
+	}
+
+	return entries, scanner.Err()
+}
+
+// writeHistoryToFile replaces the file with the history, or in append mode
+// adds only the entries not saved yet, then trims it to HISTFILESIZE
+func writeHistoryToFile(fileName string, appendMode bool) {
+	if fileName == "" {
+		fmt.Println("No history file set")
+		return
+	}
+
+	historyFile, err := openHistoryFile(fileName, true)
+	if err != nil {
+		fmt.Printf("Error opening history file: %s\n", err)
+		return
+	}
+	defer historyFile.Close()
+
+	var entries []HistoryEntry
+	if appendMode {
+		for _, entry := range HISTORY {
+			if !entry.saved {
+				entries = append(entries, entry)
+			}
+		}
+		_, err = historyFile.Seek(0, io.SeekEnd)
+	} else {
+		entries = HISTORY
+		err = historyFile.Truncate(0)
+	}
+
+	if err == nil {
+		err = writeHistoryEntries(historyFile, entries)
+	}
+	if err == nil {
+		err = trimHistoryFile(historyFile, historyFileSize())
+	}
+	if err != nil {
+		fmt.Printf("Error writing to history file: %s\n", err)
+		return
+	}
+
+	for i := range HISTORY {
+		HISTORY[i].saved = true
+	}
+}
+
+func writeHistoryEntries(writer io.Writer, entries []HistoryEntry) error {
+	buffered := bufio.NewWriter(writer)
+	for _, entry := range entries {
+		// Double trailing backslashes so they do not read as continuations
+		lines := strings.Split(redactHistory(entry.Line), "\n")
+		for i, text := range lines {
+			content := strings.TrimRight(text, "\\")
+			lines[i] = text + text[len(content):]
+		}
+		line := strings.Join(lines, "\\\n")
+		if !entry.Time.IsZero() {
+			line = formatHistoryTimestamp(entry) + "\n" + line
+		}
+
+		if _, err := buffered.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// trimHistoryFile drops the oldest entries of a locked file beyond size
+func trimHistoryFile(historyFile *os.File, size int) error {
+	if size < 0 {
+		return nil
+	}
+
+	if _, err := historyFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	entries, err := readHistoryEntries(historyFile)
+	if err != nil || len(entries) <= size {
+		return err
+	}
+
+	if err := historyFile.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := historyFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return writeHistoryEntries(historyFile, lastEntries(entries, size))
+}
+
+// isHistoryTimestamp reports whether a HISTFILE line is a bash timestamp:
+// a comment character directly followed by a digit
+func isHistoryTimestamp(line string) bool {
+	return len(line) > 1 && line[0] == '#' && line[1] >= '0' && line[1] <= '9'
+}
+
+// formatHistoryTimestamp writes the bash timestamp line for entry. bash
+// reads only the leading seconds, so the other fields follow after them:
+//
+//	#1700000000 duration=1.5s status=0 session=1234.s4b2q cwd="/home/me"
+func formatHistoryTimestamp(entry HistoryEntry) string {
+	return fmt.Sprintf("#%d duration=%s status=%d session=%s cwd=%s",
+		entry.Time.Unix(), entry.Duration.Round(time.Millisecond), entry.ExitStatus, entry.Session, strconv.Quote(entry.Cwd))
+}
+
+func parseHistoryTimestamp(line string) HistoryEntry {
+	var entry HistoryEntry
+	fields := strings.TrimPrefix(line, "#")
+
+	seconds, rest, _ := strings.Cut(fields, " ")
+	if unix, err := strconv.ParseInt(seconds, 10, 64); err == nil {
+		entry.Time = time.Unix(unix, 0)
+	}
+
+	for rest != "" {
+		var field string
+		// cwd is quoted and may hold spaces, so it is always written last
+		if strings.HasPrefix(rest, "cwd=") {
+			field, rest = rest, ""
+		} else {
+			field, rest, _ = strings.Cut(rest, " ")
+		}
+
+		name, value, _ := strings.Cut(field, "=")
+		switch name {
+		case "duration":
+			entry.Duration, _ = time.ParseDuration(value)
+		case "status":
+			entry.ExitStatus, _ = strconv.Atoi(value)
+		case "session":
+			entry.Session = value
+		case "cwd":
+			if cwd, err := strconv.Unquote(value); err == nil {
+				entry.Cwd = cwd
+			}
+		}
+	}
+
+	return entry
+}
+
+func loadHistory() {
+	fileName := getVar("HISTFILE")
+	if fileName == "" {
+		return
+	}
+
+	// A new history file is created on exit
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return
+	}
+
+	addContentsToHistory(fileName)
+}
+
+func saveHistoryOnExit() {
+	if !interactive {
+		return
+	}
+
+	fileName := getVar("HISTFILE")
+	if fileName == "" {
+		return
+	}
+
+	writeHistoryToFile(fileName, true)
+}
+
+// shareHistory is run before each prompt when the sharehistory option is
+// on: it saves this shell's new entries and picks up those of others
+func shareHistory() {
+	if !isOptionSet("sharehistory") {
+		return
+	}
+
+	fileName := getVar("HISTFILE")
+	if fileName == "" {
+		return
+	}
+
+	writeHistoryToFile(fileName, true)
+	mergeHistoryFile(fileName)
+}
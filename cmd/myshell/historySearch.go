@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// historySearch is the state of an incremental Ctrl+R / Ctrl+S search
+type historySearch struct {
+	query    []rune
+	backward bool
+	index    int // HISTORY entry of the current match, len(HISTORY) for none
+	matchPos int // rune offset of the query in the matched line
+	matchLen int // rune length of the query that matched, which a failed search outgrows
+	failed   bool
+
+	// the line being edited when the search started, restored by Ctrl+G
+	original       []rune
+	originalCursor int
+}
+
+// lastSearchQuery lets Ctrl+R on an empty query repeat the previous search
+var lastSearchQuery []rune
+
+func (e *LineEditor) startSearch(backward bool) {
+	e.search = &historySearch{
+		backward:       backward,
+		index:          len(HISTORY),
+		original:       append([]rune{}, e.buffer...),
+		originalCursor: e.cursor,
+	}
+	e.refreshSearch()
+}
+
+// handleSearchKey handles a key while a search is active
+func (e *LineEditor) handleSearchKey(key keyPress) (bool, error) {
+	s := e.search
+
+	switch key.code {
+	case keyEnter:
+		e.acceptSearch()
+		return true, nil
+
+	case keyBackspace:
+		if len(s.query) > 0 {
+			s.query = s.query[:len(s.query)-1]
+			s.index = len(HISTORY)
+			s.failed = false
+			e.findMatch(true)
+		}
+
+	case keyControl:
+		switch key.char {
+		case 'c':
+			e.search = nil
+			return false, errInterrupted
+		case 'g':
+			e.abortSearch()
+			return false, nil
+		case 'r', 's':
+			s.backward = key.char == 'r'
+			if len(s.query) == 0 {
+				s.query = append([]rune{}, lastSearchQuery...)
+				e.findMatch(true)
+			} else {
+				e.findMatch(false)
+			}
+		default:
+			e.acceptSearch()
+			return e.handleKey(key)
+		}
+
+	case keyRune:
+		if key.alt {
+			e.acceptSearch()
+			return e.handleKey(key)
+		}
+		s.query = append(s.query, key.char)
+		e.findMatch(true)
+
+	case keyEscape:
+		e.acceptSearch()
+		return false, nil
+
+	default:
+		// Arrows and other editing keys accept the match and then apply
+		e.acceptSearch()
+		return e.handleKey(key)
+	}
+
+	e.refreshSearch()
+	return false, nil
+}
+
+// findMatch moves to the next entry containing the query in the search
+// direction. When keepCurrent is set the current entry may match again,
+// which is what typing another character wants.
+func (e *LineEditor) findMatch(keepCurrent bool) {
+	s := e.search
+	if len(s.query) == 0 {
+		s.failed = false
+		return
+	}
+
+	query := string(s.query)
+	currentLine := ""
+	if s.index < len(HISTORY) {
+		currentLine = HISTORY[s.index].Line
+	}
+
+	step := 1
+	if s.backward {
+		step = -1
+	}
+
+	start := s.index
+	if !keepCurrent || s.index >= len(HISTORY) {
+		start += step
+	}
+
+	for i := start; i >= 0 && i < len(HISTORY); i += step {
+		line := HISTORY[i].Line
+		// Stepping skips entries identical to the one already shown
+		if i != s.index && line == currentLine && !keepCurrent {
+			continue
+		}
+
+		if pos := strings.Index(line, query); pos >= 0 {
+			s.index = i
+			s.matchPos = len([]rune(line[:pos]))
+			s.matchLen = len(s.query)
+			s.failed = false
+			return
+		}
+	}
+
+	s.failed = true
+	fmt.Print("\a") // ASCII Bell
+}
+
+// searchLine is the history entry currently matched, or the original line
+func (e *LineEditor) searchLine() []rune {
+	if e.search.index < len(HISTORY) {
+		return []rune(HISTORY[e.search.index].Line)
+	}
+	return e.search.original
+}
+
+// refreshSearch draws `(reverse-i-search)'query': match` with the matched
+// text highlighted and the cursor at the start of the match
+func (e *LineEditor) refreshSearch() {
+	s := e.search
+	line := e.searchLine()
+
+	label := "reverse-i-search"
+	if !s.backward {
+		label = "i-search"
+	}
+	if s.failed {
+		label = "failed " + label
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "\r\033[K(%s)'%s': ", label, string(s.query))
+
+	cursor := len(line)
+	if s.index < len(HISTORY) && len(s.query) > 0 {
+		end := min(s.matchPos+s.matchLen, len(line))
+		out.WriteString(string(line[:s.matchPos]))
+		out.WriteString("\033[7m" + string(line[s.matchPos:end]) + "\033[27m") // reverse video
+		out.WriteString(string(line[end:]))
+		cursor = s.matchPos
+	} else {
+		out.WriteString(string(line))
+	}
+
+	if back := displayWidth(line[cursor:]); back > 0 {
+		fmt.Fprintf(&out, "\033[%dD", back)
+	}
+
+	fmt.Print(out.String())
+}
+
+// acceptSearch ends the search leaving the match in the buffer, with up
+// and down continuing through history from there
+func (e *LineEditor) acceptSearch() {
+	s := e.search
+	e.search = nil
+
+	if len(s.query) > 0 {
+		lastSearchQuery = s.query
+	}
+
+	if s.index < len(HISTORY) {
+		e.buffer = []rune(HISTORY[s.index].Line)
+		e.cursor = s.matchPos
+		lastCommandPos = s.index
+	} else {
+		e.buffer = s.original
+		e.cursor = s.originalCursor
+	}
+	e.refresh()
+}
+
+// abortSearch ends the search and restores the line as it was
+func (e *LineEditor) abortSearch() {
+	s := e.search
+	e.search = nil
+
+	e.buffer = s.original
+	e.cursor = s.originalCursor
+	e.refresh()
+}
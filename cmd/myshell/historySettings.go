@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// historySize is HISTSIZE, the number of entries kept in memory. A
+// negative size keeps every entry.
+func historySize() int {
+	return historyLimit("HISTSIZE", MAX_HISTORY)
+}
+
+// historyFileSize is HISTFILESIZE, the number of entries the history file
+// is trimmed to when saved. It defaults to HISTSIZE, as in bash.
+func historyFileSize() int {
+	return historyLimit("HISTFILESIZE", historySize())
+}
+
+func historyLimit(name string, fallback int) int {
+	value, ok := lookupVar(name)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return limit
+}
+
+// historyControl returns the HISTCONTROL settings that are on, with
+// ignoreboth standing for ignorespace and ignoredups. As in bash, every
+// line is kept while HISTCONTROL is unset.
+func historyControl() map[string]bool {
+	control := make(map[string]bool)
+	for _, setting := range strings.Split(getVar("HISTCONTROL"), ":") {
+		if setting == "ignoreboth" {
+			control["ignorespace"] = true
+			control["ignoredups"] = true
+			continue
+		}
+		control[setting] = true
+	}
+	return control
+}
+
+// isHistoryIgnored reports whether line matches one of the HISTIGNORE
+// patterns. Each pattern must match the whole line, and & stands for the
+// previous history entry.
+func isHistoryIgnored(line string) bool {
+	for _, pattern := range splitHistoryIgnore(getVar("HISTIGNORE")) {
+		if pattern == "&" {
+			if len(HISTORY) > 0 && HISTORY[len(HISTORY)-1].Line == line {
+				return true
+			}
+			continue
+		}
+
+		if globMatch(pattern, line) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHistoryIgnore splits HISTIGNORE on colons, except ones escaped with
+// a backslash
+func splitHistoryIgnore(value string) []string {
+	var patterns []string
+	var pattern strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == backslash && i+1 < len(value) && value[i+1] == ':':
+			pattern.WriteByte(':')
+			i++
+		case value[i] == ':':
+			if pattern.Len() > 0 {
+				patterns = append(patterns, pattern.String())
+			}
+			pattern.Reset()
+		default:
+			pattern.WriteByte(value[i])
+		}
+	}
+
+	if pattern.Len() > 0 {
+		patterns = append(patterns, pattern.String())
+	}
+	return patterns
+}
+
+// recordHistory adds the line the user entered to the history unless
+// HISTCONTROL or HISTIGNORE leave it out, or `set +o history` turned
+// recording off, and reports whether it did
+func recordHistory(entry HistoryEntry) bool {
+	currentLineRecorded = false
+	if !isOptionSet("history") || strings.TrimSpace(entry.Line) == "" {
+		return false
+	}
+
+	// Secrets are redacted before comparing with the entries already kept
+	entry.Line = redactHistory(entry.Line)
+
+	control := historyControl()
+	if control["ignorespace"] && strings.HasPrefix(entry.Line, " ") {
+		return false
+	}
+	if control["ignoredups"] && len(HISTORY) > 0 && HISTORY[len(HISTORY)-1].Line == entry.Line {
+		return false
+	}
+	if isHistoryIgnored(entry.Line) {
+		return false
+	}
+
+	if control["erasedups"] {
+		kept := HISTORY[:0]
+		for _, previous := range HISTORY {
+			if previous.Line != entry.Line {
+				kept = append(kept, previous)
+			}
+		}
+		HISTORY = kept
+	}
+
+	addCmdToHistory(entry)
+	currentLineRecorded = true
+	return true
+}
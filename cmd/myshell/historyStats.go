@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// historyStatsDefault is how many rows each table of `history stats` shows
+const historyStatsDefault = 10
+
+// historyCount is one row of a `history stats` table
+type historyCount struct {
+	name   string
+	count  int
+	failed int
+}
+
+// historyCounter tallies entries under a name, keeping the order names
+// were first seen for ties
+type historyCounter struct {
+	counts map[string]*historyCount
+	order  []string
+}
+
+func newHistoryCounter() *historyCounter {
+	return &historyCounter{counts: make(map[string]*historyCount)}
+}
+
+func (counter *historyCounter) add(name string, failed bool) {
+	count, ok := counter.counts[name]
+	if !ok {
+		count = &historyCount{name: name}
+		counter.counts[name] = count
+		counter.order = append(counter.order, name)
+	}
+
+	count.count++
+	if failed {
+		count.failed++
+	}
+}
+
+// top returns the n names seen most often
+func (counter *historyCounter) top(n int) []historyCount {
+	rows := make([]historyCount, 0, len(counter.order))
+	for _, name := range counter.order {
+		rows = append(rows, *counter.counts[name])
+	}
+	slices.SortStableFunc(rows, func(a, b historyCount) int {
+		return cmp.Compare(b.count, a.count)
+	})
+	return rows[:min(n, len(rows))]
+}
+
+// handleHistoryStats prints the most used commands, how often they fail,
+// and the directories and hours with the most commands
+func handleHistoryStats(args []string) {
+	limit := historyStatsDefault
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "history: stats: too many arguments")
+		lastExitStatus = 2
+		return
+	}
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			fmt.Fprintf(os.Stderr, "history: stats: %s: positive number required\n", args[0])
+			lastExitStatus = 1
+			return
+		}
+		limit = n
+	}
+
+	// The stats command itself has no exit status yet
+	entries := HISTORY
+	if currentLineRecorded && len(entries) > 0 {
+		entries = entries[:len(entries)-1]
+	}
+	if len(entries) == 0 {
+		fmt.Println("history: no entries")
+		return
+	}
+
+	commands := newHistoryCounter()
+	directories := newHistoryCounter()
+	hours := newHistoryCounter()
+	sessions := make(map[string]bool)
+	failed := 0
+
+	for _, entry := range entries {
+		// Entries without a timestamp came from a plain history file and
+		// have no status, directory or time
+		isFailure := !entry.Time.IsZero() && entry.ExitStatus != 0
+		if isFailure {
+			failed++
+		}
+
+		commands.add(historyCommandName(entry.Line), isFailure)
+		if entry.Cwd != "" {
+			directories.add(entry.Cwd, isFailure)
+		}
+		if !entry.Time.IsZero() {
+			hours.add(fmt.Sprintf("%02d:00", entry.Time.Hour()), isFailure)
+		}
+		if entry.Session != "" {
+			sessions[entry.Session] = true
+		}
+	}
+
+	fmt.Printf("%d commands in %d sessions, %s\n", len(entries), len(sessions), failureRate(failed, len(entries)))
+
+	fmt.Println("\nMost used commands:")
+	for _, row := range commands.top(limit) {
+		fmt.Printf("%6d  %-20s %s\n", row.count, row.name, failureRate(row.failed, row.count))
+	}
+
+	if rows := directories.top(limit); len(rows) > 0 {
+		fmt.Println("\nBusiest directories:")
+		for _, row := range rows {
+			fmt.Printf("%6d  %s\n", row.count, row.name)
+		}
+	}
+
+	if rows := hours.top(limit); len(rows) > 0 {
+		fmt.Println("\nBusiest hours:")
+		busiest := rows[0].count
+		for _, row := range rows {
+			// Bars are scaled so the busiest hour is 40 wide
+			bar := strings.Repeat("#", max(1, row.count*40/busiest))
+			fmt.Printf("%6d  %s  %s\n", row.count, row.name, bar)
+		}
+	}
+}
+
+// historyCommandName is the command a history line runs: its first word
+// after any NAME=value assignments
+func historyCommandName(line string) string {
+	for _, word := range historyWords(line) {
+		name, _, isAssignment := strings.Cut(word, "=")
+		if isAssignment && isValidVarName(name) {
+			continue
+		}
+		// ls;pwd runs ls
+		if end := strings.IndexAny(word, ";|&<>()"); end > 0 {
+			word = word[:end]
+		}
+		return word
+	}
+	return line
+}
+
+func failureRate(failed, total int) string {
+	return fmt.Sprintf("%d failed (%.1f%%)", failed, float64(failed)*100/float64(total))
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// escapeTimeout separates a lone Esc key press from the start of an escape
+// sequence such as an arrow key
+const escapeTimeout = 50 * time.Millisecond
+
+var (
+	errInterrupted = errors.New("interrupted")
+	errEndOfInput  = errors.New("end of input")
+)
+
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyControl
+	keyEnter
+	keyTab
+	keyBackspace
+	keyDelete
+	keyEscape
+	keyLeft
+	keyRight
+	keyUp
+	keyDown
+	keyHome
+	keyEnd
+	keyBackTab // Shift+Tab
+	keyUnknown
+)
+
+// keyPress is one decoded key. char holds the rune for keyRune and the
+// lower-case letter for keyControl; alt is set when it came prefixed by Esc.
+type keyPress struct {
+	code keyCode
+	char rune
+	alt  bool
+}
+
+// LineEditor reads one line from the terminal in raw mode, keeping a
+// cursor into the buffer so text can be inserted and deleted anywhere.
+type LineEditor struct {
+	prompt string
+	buffer []rune
+	cursor int
+	fd     int
+
+	termState *term.State // terminal state to restore when leaving raw mode
+
+	lastAction editorAction // what the previous key did
+	thisAction editorAction // what the current key did, set by its handler
+	yankStart  int          // where the last Ctrl+Y inserted text
+
+	historyPrefix string // text before the cursor when Up or Down started
+	historyDraft  []rune // the line being typed before moving through history
+	lastArgOffset int    // how many entries back the last Alt+. looked
+
+	vi     *viState       // nil unless vi editing mode is enabled
+	search *historySearch // set while Ctrl+R or Ctrl+S is searching
+
+	listed []completion    // candidates the last Tab listed, for the menu
+	menu   *completionMenu // set while a completion menu is open
+}
+
+func NewLineEditor(prompt string) *LineEditor {
+	return &LineEditor{
+		prompt: prompt,
+		fd:     int(os.Stdin.Fd()),
+	}
+}
+
+// ReadLine prints the prompt and returns the line once Enter is pressed. It
+// returns errEndOfInput for Ctrl+D on an empty line and errInterrupted for
+// Ctrl+C.
+func (e *LineEditor) ReadLine() (string, error) {
+	oldState, err := term.MakeRaw(e.fd)
+	if err != nil {
+		return "", fmt.Errorf("setting raw mode: %w", err)
+	}
+	defer term.Restore(e.fd, oldState)
+	e.termState = oldState
+	lastCommandPos = len(HISTORY)
+
+	fmt.Print(e.modeIndicator() + e.prompt)
+
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return "", err
+		}
+
+		e.thisAction = actionOther
+		done, err := e.handleKey(key)
+		e.lastAction = e.thisAction
+		if err != nil {
+			fmt.Print("\n\r")
+			return "", err
+		}
+		if done {
+			fmt.Print("\n\r")
+			return string(e.buffer), nil
+		}
+	}
+}
+
+// handleKey applies key to the buffer and reports whether the line is done
+func (e *LineEditor) handleKey(key keyPress) (bool, error) {
+	if e.search != nil {
+		return e.handleSearchKey(key)
+	}
+	if e.menu != nil {
+		return e.handleMenuKey(key)
+	}
+
+	if e.vi != nil {
+		if !e.vi.insertMode {
+			return e.handleViNormalKey(key)
+		}
+		if e.handleViInsertKey(key) {
+			return false, nil
+		}
+	}
+
+	switch key.code {
+	case keyEnter:
+		return true, nil
+
+	case keyTab:
+		e.complete()
+
+	case keyBackspace:
+		if key.alt {
+			e.handleEmacsKey(key)
+		} else if e.cursor > 0 {
+			e.deleteRange(e.previousCharStart(), e.cursor)
+		}
+
+	case keyDelete:
+		e.deleteRange(e.cursor, e.nextCharEnd())
+
+	case keyLeft:
+		e.moveTo(e.previousCharStart())
+
+	case keyRight:
+		e.moveTo(e.nextCharEnd())
+
+	case keyHome:
+		e.moveTo(0)
+
+	case keyEnd:
+		e.moveTo(len(e.buffer))
+
+	case keyUp:
+		e.historyPrevious()
+
+	case keyDown:
+		e.historyNext()
+
+	case keyControl:
+		// Ctrl+X Ctrl+E edits the line in $EDITOR and runs the result
+		if key.char == 'e' && e.lastAction == actionCtrlX {
+			return e.editBufferInEditor()
+		}
+
+		switch key.char {
+		case 'c':
+			return false, errInterrupted
+		case 'd':
+			if len(e.buffer) == 0 {
+				return false, errEndOfInput
+			}
+			e.deleteRange(e.cursor, e.nextCharEnd())
+		case 'r', 's':
+			e.startSearch(key.char == 'r')
+		default:
+			e.handleEmacsKey(key)
+		}
+
+	case keyRune:
+		if !key.alt && isInsertable(key.char) {
+			e.insert([]rune{key.char})
+		} else {
+			e.handleEmacsKey(key)
+		}
+	}
+
+	return false, nil
+}
+
+func (e *LineEditor) insert(text []rune) {
+	atEnd := e.cursor == len(e.buffer)
+
+	e.buffer = append(e.buffer[:e.cursor], append(text, e.buffer[e.cursor:]...)...)
+	e.cursor += len(text)
+
+	// Appending needs no redraw, which keeps the output simple for the
+	// common case of typing at the end of the line
+	if atEnd {
+		fmt.Print(string(text))
+		return
+	}
+	e.refresh()
+}
+
+func (e *LineEditor) deleteRange(start, end int) {
+	start = max(start, 0)
+	end = min(end, len(e.buffer))
+	if start >= end {
+		return
+	}
+
+	e.buffer = append(e.buffer[:start], e.buffer[end:]...)
+	e.cursor = start
+	e.refresh()
+}
+
+func (e *LineEditor) moveTo(pos int) {
+	pos = max(0, min(pos, len(e.buffer)))
+	if pos == e.cursor {
+		return
+	}
+
+	// The terminal moves in columns, and wide characters take two
+	if pos < e.cursor {
+		fmt.Printf("\033[%dD", displayWidth(e.buffer[pos:e.cursor]))
+	} else {
+		fmt.Printf("\033[%dC", displayWidth(e.buffer[e.cursor:pos]))
+	}
+	e.cursor = pos
+}
+
+// previousCharStart and nextCharEnd step over whole user-perceived
+// characters, so combining marks and emoji sequences move as one
+func (e *LineEditor) previousCharStart() int {
+	return previousGraphemeStart(e.buffer, e.cursor)
+}
+
+func (e *LineEditor) nextCharEnd() int {
+	return nextGraphemeEnd(e.buffer, e.cursor)
+}
+
+// startHistoryNavigation remembers what was typed, so Up and Down only
+// show entries starting with it and Down past the newest brings it back
+func (e *LineEditor) startHistoryNavigation() {
+	if e.lastAction != actionHistory {
+		e.historyPrefix = string(e.buffer[:e.cursor])
+		e.historyDraft = append([]rune{}, e.buffer...)
+	}
+	e.thisAction = actionHistory
+}
+
+func (e *LineEditor) historyPrevious() {
+	e.startHistoryNavigation()
+	if line, ok := getPreviousCommand(e.historyPrefix, string(e.buffer)); ok {
+		e.setHistoryLine(line)
+	}
+}
+
+func (e *LineEditor) historyNext() {
+	e.startHistoryNavigation()
+	if line, ok := getNextCommand(e.historyPrefix, string(e.buffer)); ok {
+		e.setHistoryLine(line)
+	} else {
+		e.setHistoryLine(string(e.historyDraft))
+	}
+}
+
+// setHistoryLine shows a history entry, keeping the cursor after the
+// prefix being searched for
+func (e *LineEditor) setHistoryLine(line string) {
+	e.setBuffer(line)
+	if e.historyPrefix != "" {
+		e.moveTo(len([]rune(e.historyPrefix)))
+	}
+}
+
+func (e *LineEditor) setBuffer(line string) {
+	e.buffer = []rune(line)
+	e.cursor = len(e.buffer)
+	e.refresh()
+}
+
+// refresh redraws the prompt and buffer and puts the cursor back in place
+func (e *LineEditor) refresh() {
+	var out strings.Builder
+	out.WriteString("\r\033[K")
+	out.WriteString(e.modeIndicator())
+	out.WriteString(e.prompt)
+	out.WriteString(string(e.buffer))
+	if back := displayWidth(e.buffer[e.cursor:]); back > 0 {
+		fmt.Fprintf(&out, "\033[%dD", back)
+	}
+
+	fmt.Print(out.String())
+	os.Stdout.Sync() // Force flush
+}
+
+// withTerminalRestored runs fn with the terminal out of raw mode, for
+// programs such as an editor that need it back
+func (e *LineEditor) withTerminalRestored(fn func()) {
+	term.Restore(e.fd, e.termState)
+	defer term.MakeRaw(e.fd)
+	fn()
+}
+
+func (e *LineEditor) complete() {
+	e.thisAction = actionComplete
+	if e.lastAction != actionComplete {
+		tabCount = 0
+		e.listed = nil
+	}
+
+	// Tab again after the candidates were listed opens a menu of them
+	if e.listed != nil {
+		e.startMenu(e.listed)
+		e.listed = nil
+		return
+	}
+
+	line := string(e.buffer)
+	cursor := len(string(e.buffer[:e.cursor]))
+	completed, cursor, matches := autoComplete(line, cursor)
+	if matches != nil && e.listCompletions(matches) {
+		e.listed = matches
+	}
+
+	e.buffer = []rune(completed)
+	e.cursor = utf8.RuneCountInString(completed[:cursor])
+	e.refresh()
+}
+
+func (e *LineEditor) readByte() (byte, error) {
+	var buf [1]byte
+	for {
+		n, err := os.Stdin.Read(buf[:])
+		if err != nil {
+			return 0, err
+		}
+		if n == 1 {
+			return buf[0], nil
+		}
+	}
+}
+
+// readKey reads and decodes the next key, including multi-byte escape
+// sequences for arrows, Home, End and Delete
+func (e *LineEditor) readKey() (keyPress, error) {
+	char, err := e.readByte()
+	if err != nil {
+		return keyPress{}, err
+	}
+
+	if char == 27 { // Escape sequence
+		return e.readEscapeSequence()
+	}
+	if char >= utf8.RuneSelf {
+		return e.readRune(char)
+	}
+	return decodeByte(char), nil
+}
+
+// readRune reads the rest of a multi-byte UTF-8 character whose first
+// byte is first. Invalid input decodes to the replacement character.
+func (e *LineEditor) readRune(first byte) (keyPress, error) {
+	var size int
+	switch {
+	case first&0xE0 == 0xC0:
+		size = 2
+	case first&0xF0 == 0xE0:
+		size = 3
+	case first&0xF8 == 0xF0:
+		size = 4
+	default:
+		return keyPress{code: keyRune, char: utf8.RuneError}, nil
+	}
+
+	encoded := []byte{first}
+	for len(encoded) < size {
+		next, err := e.readByte()
+		if err != nil {
+			return keyPress{}, err
+		}
+		encoded = append(encoded, next)
+	}
+
+	char, _ := utf8.DecodeRune(encoded)
+	return keyPress{code: keyRune, char: char}, nil
+}
+
+func (e *LineEditor) readEscapeSequence() (keyPress, error) {
+	if !waitForInput(e.fd, time.Now().Add(escapeTimeout)) {
+		return keyPress{code: keyEscape}, nil
+	}
+
+	next, err := e.readByte()
+	if err != nil {
+		return keyPress{}, err
+	}
+
+	if next != '[' && next != 'O' {
+		// Esc followed by a key is how terminals send Alt+key
+		key := decodeByte(next)
+		if next >= utf8.RuneSelf {
+			if key, err = e.readRune(next); err != nil {
+				return keyPress{}, err
+			}
+		}
+		key.alt = true
+		return key, nil
+	}
+
+	// CSI sequences end with a byte in the range '@' to '~'
+	var params strings.Builder
+	for {
+		final, err := e.readByte()
+		if err != nil {
+			return keyPress{}, err
+		}
+		if final >= '@' && final <= '~' {
+			return decodeCSI(params.String(), final), nil
+		}
+		params.WriteByte(final)
+	}
+}
+
+// decodeByte decodes a single-byte key
+func decodeByte(char byte) keyPress {
+	switch char {
+	case '\n', '\r': //  Enter key
+		return keyPress{code: keyEnter}
+	case '\t': // Tab : autocomplete
+		return keyPress{code: keyTab}
+	case 127, 8: // Backspace (127 is DEL, 8 is BS)
+		return keyPress{code: keyBackspace}
+	}
+
+	if char < 32 {
+		return keyPress{code: keyControl, char: rune('a' + char - 1)}
+	}
+	return keyPress{code: keyRune, char: rune(char)}
+}
+
+func decodeCSI(params string, final byte) keyPress {
+	switch final {
+	case 'A':
+		return keyPress{code: keyUp}
+	case 'B':
+		return keyPress{code: keyDown}
+	case 'C':
+		return keyPress{code: keyRight}
+	case 'D':
+		return keyPress{code: keyLeft}
+	case 'H':
+		return keyPress{code: keyHome}
+	case 'F':
+		return keyPress{code: keyEnd}
+	case 'Z':
+		return keyPress{code: keyBackTab}
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyPress{code: keyHome}
+		case "4", "8":
+			return keyPress{code: keyEnd}
+		case "3":
+			return keyPress{code: keyDelete}
+		}
+	}
+
+	return keyPress{code: keyUnknown}
+}
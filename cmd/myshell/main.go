@@ -4,23 +4,50 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
-	"strings"
+	"slices"
 )
 
-var builtInCommands = []string{"exit", "echo", "type", "pwd", "cd", "history"}
+var builtInCommands = []string{"exit", "echo", "type", "pwd", "cd", "history", "read", "printf", "declare", "set", "fc", "unset", "complete", "compgen", "hash", "alias", "unalias"}
+
+// interactive is false when running a command string passed with -c
+var interactive = true
 
 func main() {
+	if len(os.Args) > 2 && os.Args[1] == "-c" {
+		interactive = false
+		runCommandList(os.Args[2])
+		os.Exit(lastExitStatus)
+	}
+
 	loadHistory()
 
 	for {
-		fmt.Fprint(os.Stdout, "$ ")
-
+		shareHistory()
 		userInput := readUserInput()
 
-		parsedCommand := parseInput(userInput)
+		expansion, err := expandHistory(userInput)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			lastExitStatus = 1
+			continue
+		}
+		// Like bash, show the line that history expansion produced
+		if expansion.expanded {
+			fmt.Println(expansion.line)
+		}
+		userInput = expansion.line
+
+		entry := newHistoryEntry(userInput)
+		recorded := recordHistory(entry)
+		if expansion.printOnly {
+			continue
+		}
+
+		runCommandList(userInput)
 
-		addCmdToHistory(parsedCommand)
-		handleCommand(&parsedCommand)
+		if recorded {
+			finishHistoryEntry(entry, lastExitStatus)
+		}
 	}
 }
 
@@ -30,122 +57,251 @@ func handleCommand(parsedCmd *ParsedCommand) {
 		return
 	}
 
-	var outputFile *os.File
-	var originalStd *os.File
-	var err error
+	setup := setUpCommand(parsedCmd)
+	defer setup.finish()
+	defer setup.restore()
+	if setup.cmd == nil {
+		return
+	}
+	parsedCmd = setup.cmd
+
+	if parsedCmd.Group != NoGroup {
+		runGroup(parsedCmd)
+		return
+	}
+
+	lastExitStatus = 0
 
-	if parsedCmd.RedirType != NoRedirection {
-		outputFile, originalStd, err = handleRedirection(parsedCmd.RedirType, parsedCmd.RedirFile)
+	switch {
+	case isFunction(parsedCmd.Cmd):
+		runFunction(parsedCmd.Cmd, parsedCmd.Args)
+	case parsedCmd.Cmd == "exit":
+		handleExitCmd(parsedCmd.Args)
+	case slices.Contains(builtInCommands, parsedCmd.Cmd):
+		executeBuiltinCommand(parsedCmd)
+	default:
+		runCommand(parsedCmd.Cmd, parsedCmd.Args, setup.extraFiles)
+	}
+}
+
+// commandSetup is what surrounds running a command: its redirections, its
+// NAME=value prefixes and its process substitutions
+type commandSetup struct {
+	cmd        *ParsedCommand // with substituted arguments, nil when nothing is left to run
+	extraFiles []*os.File     // the substitutions' pipe ends for an external command
+
+	restores []func() // put the std streams and variables back
+	finishes []func() // close the files and wait for the substituted processes
+}
+
+// setUpCommand applies the redirections of cmd and, for a simple command,
+// its assignments and process substitutions. A command on its own is run
+// between restore and finish; the left side of a pipe is restored as soon
+// as it has started, and finished when it ends.
+func setUpCommand(parsedCmd *ParsedCommand) *commandSetup {
+	setup := &commandSetup{}
+
+	if len(parsedCmd.Redirects) > 0 {
+		restoreStd, closeFiles, err := applyRedirections(parsedCmd.Redirects)
 		if err != nil {
 			fmt.Println("Error handling redirection:", err)
-			return
+			lastExitStatus = 1
+			return setup
 		}
+		setup.restores = append(setup.restores, restoreStd)
+		setup.finishes = append(setup.finishes, closeFiles)
+	}
 
-		// Ensure we close the file and restore original std streams
-		defer func() {
-			if outputFile != nil {
-				outputFile.Close()
-			}
-			if originalStd != nil {
-				switch parsedCmd.RedirType {
-				case OutputRedirection, AppendOutRedirection:
-					os.Stdout = originalStd
-				case InputRedirection:
-					os.Stdin = originalStd
-				case ErrorRedirection, AppendErrRedirection:
-					os.Stderr = originalStd
-				}
+	if parsedCmd.Group != NoGroup {
+		setup.cmd = parsedCmd
+		return setup
+	}
+
+	if len(parsedCmd.Assignments) > 0 {
+		if parsedCmd.Cmd == "" {
+			lastExitStatus = 0
+			if err := applyAssignments(parsedCmd.Assignments); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				lastExitStatus = 1
 			}
-		}()
+			return setup
+		}
+
+		setup.restores = append(setup.restores, applyTempAssignments(parsedCmd.Assignments))
 	}
 
-	switch parsedCmd.Cmd {
-	case "exit":
-		handleExitCmd(parsedCmd.Args)
-	case "echo":
-		if len(parsedCmd.Args) > 0 {
-			fmt.Println(strings.Join(parsedCmd.Args, " "))
-		}
-	case "type":
-		handleTypeCmd(parsedCmd.Args)
-	case "pwd":
-		handlePwdCmd()
-	case "cd":
-		handleCdCmd(parsedCmd.Args)
-	case "history":
-		handleHistoryCmd(parsedCmd.Args)
-	default:
-		runCommand(parsedCmd.Cmd, parsedCmd.Args)
+	if len(parsedCmd.ProcSubsts) > 0 {
+		isExternal := !runsInShell(parsedCmd.Cmd)
+		args, files, finishSubsts, err := startProcessSubstitutions(parsedCmd, isExternal)
+		if err != nil {
+			fmt.Println("Error starting process substitution:", err)
+			lastExitStatus = 1
+			return setup
+		}
+		setup.finishes = append(setup.finishes, finishSubsts)
+
+		substituted := *parsedCmd
+		substituted.Args = args
+		parsedCmd = &substituted
+		setup.extraFiles = files
+	}
+
+	setup.cmd = parsedCmd
+	return setup
+}
+
+// restore undoes the setup in reverse order, once
+func (setup *commandSetup) restore() {
+	for i := len(setup.restores) - 1; i >= 0; i-- {
+		setup.restores[i]()
+	}
+	setup.restores = nil
+}
+
+// finish closes the setup's files and waits for its substituted processes
+func (setup *commandSetup) finish() {
+	for i := len(setup.finishes) - 1; i >= 0; i-- {
+		setup.finishes[i]()
+	}
+	setup.finishes = nil
+}
+
+// applyRedirections applies redirects in order and returns a func that
+// restores the original std streams, and one that then closes any files it
+// opened and waits for the processes of `> >(cmd)` targets.
+func applyRedirections(redirects []Redirection) (func(), func(), error) {
+	originalStdin, originalStdout, originalStderr := os.Stdin, os.Stdout, os.Stderr
+	var openedFiles []*os.File
+	var substWaits []func()
+
+	restoreStd := func() {
+		os.Stdin, os.Stdout, os.Stderr = originalStdin, originalStdout, originalStderr
+	}
+	closeFiles := func() {
+		for _, file := range openedFiles {
+			file.Close()
+		}
+		for _, wait := range substWaits {
+			wait()
+		}
+	}
+
+	for _, redirect := range redirects {
+		if redirect.ProcSubst != nil {
+			mainEnd, wait, err := startSubstitutedProcess(*redirect.ProcSubst)
+			if err != nil {
+				restoreStd()
+				closeFiles()
+				return nil, nil, err
+			}
+			openedFiles = append(openedFiles, mainEnd)
+			substWaits = append(substWaits, wait)
+			redirect.File = fmt.Sprintf("/dev/fd/%d", mainEnd.Fd())
+		}
+
+		file, err := handleRedirection(redirect.Type, redirect.File)
+		if err != nil {
+			restoreStd()
+			closeFiles()
+			return nil, nil, err
+		}
+		if file != nil {
+			openedFiles = append(openedFiles, file)
+		}
 	}
+
+	return restoreStd, closeFiles, nil
 }
 
-func handleRedirection(redirType RedirectionType, redirFile string) (*os.File, *os.File, error) {
-	var outputFile *os.File
-	var originalStd *os.File
+func handleRedirection(redirType RedirectionType, redirFile string) (*os.File, error) {
+	var file *os.File
 	var err error
 
 	if redirType == OutputRedirection {
-		outputFile, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		file, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not create output file: %w", err)
+			return nil, fmt.Errorf("could not create output file: %w", err)
 		}
 
-		originalStd = os.Stdout
-		os.Stdout = outputFile
+		os.Stdout = file
 	} else if redirType == InputRedirection {
-		inputFile, err := os.Open(redirFile)
+		file, err = os.Open(redirFile)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not open input file: %w", err)
+			return nil, fmt.Errorf("could not open input file: %w", err)
 		}
 
-		originalStd = os.Stdin
-		os.Stdin = inputFile
+		os.Stdin = file
 	} else if redirType == ErrorRedirection {
-		outputFile, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		file, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not create error file: %w", err)
+			return nil, fmt.Errorf("could not create error file: %w", err)
 		}
 
-		originalStd = os.Stderr
-		os.Stderr = outputFile
+		os.Stderr = file
 	} else if redirType == AppendOutRedirection {
-		outputFile, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		file, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not open file for appending: %w", err)
+			return nil, fmt.Errorf("could not open file for appending: %w", err)
 		}
 
-		originalStd = os.Stdout
-		os.Stdout = outputFile
+		os.Stdout = file
 	} else if redirType == AppendErrRedirection {
-		outputFile, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		file, err = os.OpenFile(redirFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			return nil, nil, fmt.Errorf("could not open file for appending: %w", err)
+			return nil, fmt.Errorf("could not open file for appending: %w", err)
 		}
 
-		originalStd = os.Stderr
-		os.Stderr = outputFile
+		os.Stderr = file
+	} else if redirType == ErrToOutRedirection {
+		os.Stderr = os.Stdout
+	} else if redirType == OutToErrRedirection {
+		os.Stdout = os.Stderr
 	} else {
-		return nil, nil, fmt.Errorf("unknown redirection type")
+		return nil, fmt.Errorf("unknown redirection type")
+	}
+
+	return file, nil
+}
+
+// newExternalCommand prepares a command found through the hash table, so
+// PATH is not searched again. A name that is not found is left for Run to
+// fail on.
+func newExternalCommand(name string, args []string) *exec.Cmd {
+	path, ok := hashCommand(name)
+	if !ok {
+		return exec.Command(name, args...)
 	}
 
-	return outputFile, originalStd, nil
+	command := exec.Command(path, args...)
+	command.Args[0] = name
+	return command
 }
 
-func runCommand(cmd string, args []string) {
-	command := exec.Command(cmd, args...)
+func runCommand(cmd string, args []string, extraFiles []*os.File) {
+	command := newExternalCommand(cmd, args)
 	command.Stdout = os.Stdout
 	command.Stderr = os.Stderr
 	command.Stdin = os.Stdin
+	command.ExtraFiles = extraFiles
 
-	err := command.Run()
+	err := command.Start()
+	if err == nil {
+		runPipeStarted()
+		err = command.Wait()
+	}
 	if err != nil {
 		// Check if it's an ExitError (command found but exited with non-zero status)
-		if _, ok := err.(*exec.ExitError); ok {
+		if exitErr, ok := err.(*exec.ExitError); ok {
 			// Command was found and ran, but exited with error
 			// Don't print "command not found" - the command already printed its error
+			lastExitStatus = exitErr.ExitCode()
 			return
 		}
 		// This is likely a "command not found" or similar startup error
 		fmt.Fprintf(os.Stderr, "%s: command not found\n", cmd)
+		lastExitStatus = 127
+		return
 	}
+
+	lastExitStatus = 0
 }
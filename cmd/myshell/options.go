@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+// shellOptions are the `set -o` options. emacs and vi select the line
+// editing mode and are mutually exclusive; histexpand turns on ! history
+// expansion, histredact hides secrets in the history, history records
+// commands at all and sharehistory merges HISTFILE with other shells at
+// every prompt.
+var shellOptions = map[string]bool{
+	"emacs":        true,
+	"histexpand":   true,
+	"histredact":   true,
+	"history":      true,
+	"sharehistory": false,
+	"vi":           false,
+}
+
+// exclusiveOptions lists options that switch each other off
+var exclusiveOptions = map[string]string{
+	"emacs": "vi",
+	"vi":    "emacs",
+}
+
+func isOptionSet(name string) bool {
+	return shellOptions[name]
+}
+
+func setOption(name string, enabled bool) error {
+	if _, ok := shellOptions[name]; !ok {
+		return fmt.Errorf("%s: invalid option name", name)
+	}
+
+	shellOptions[name] = enabled
+	if other, ok := exclusiveOptions[name]; ok {
+		shellOptions[other] = !enabled
+	}
+	return nil
+}
+
+func handleSetCmd(args []string) {
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "-o" || args[0] == "+o")) {
+		printOptions(len(args) == 1 && args[0] == "+o")
+		return
+	}
+
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag != "-o" && flag != "+o" {
+			fmt.Fprintf(os.Stderr, "set: %s: invalid option\n", flag)
+			fmt.Fprintln(os.Stderr, "set: usage: set [-o option] [+o option]")
+			lastExitStatus = 2
+			return
+		}
+
+		i++
+		if i >= len(args) {
+			printOptions(flag == "+o")
+			return
+		}
+
+		if err := setOption(args[i], flag == "-o"); err != nil {
+			fmt.Fprintf(os.Stderr, "set: %v\n", err)
+			lastExitStatus = 1
+			return
+		}
+	}
+}
+
+// printOptions lists every option, as `set -o` does, or as the commands
+// that would restore them for `set +o`
+func printOptions(asCommands bool) {
+	names := make([]string, 0, len(shellOptions))
+	for name := range shellOptions {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if asCommands {
+			flag := "+o"
+			if shellOptions[name] {
+				flag = "-o"
+			}
+			fmt.Printf("set %s %s\n", flag, name)
+			continue
+		}
+
+		state := "off"
+		if shellOptions[name] {
+			state = "on"
+		}
+		fmt.Printf("%-15s\t%s\n", name, state)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+func handleEchoCmd(args []string) {
+	newline := true
+	interpretEscapes := false
+
+	// Leading words made only of n, e and E are options, anything else is text
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' && strings.Trim(args[0][1:], "neE") == "" {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'n':
+				newline = false
+			case 'e':
+				interpretEscapes = true
+			case 'E':
+				interpretEscapes = false
+			}
+		}
+		args = args[1:]
+	}
+
+	output := strings.Join(args, " ")
+	if interpretEscapes {
+		expanded, stop := expandBackslashEscapes(output, true)
+		output = expanded
+		if stop {
+			newline = false
+		}
+	}
+
+	if newline {
+		output += "\n"
+	}
+	fmt.Print(output)
+}
+
+// expandBackslashEscapes interprets \n, \t, \xHH and friends. echoStyle
+// selects the echo -e / %b octal form \0nnn instead of printf's \nnn. stop
+// reports a \c, after which all further output is suppressed.
+func expandBackslashEscapes(input string, echoStyle bool) (string, bool) {
+	var result strings.Builder
+
+	for i := 0; i < len(input); i++ {
+		if input[i] != backslash {
+			result.WriteByte(input[i])
+			continue
+		}
+
+		expanded, consumed, stop := expandEscapeAt(input, i, echoStyle)
+		if stop {
+			return result.String(), true
+		}
+		result.WriteString(expanded)
+		i += consumed - 1
+	}
+
+	return result.String(), false
+}
+
+// expandEscapeAt expands the single escape starting with the backslash at
+// pos and returns it with the number of bytes it used
+func expandEscapeAt(input string, pos int, echoStyle bool) (string, int, bool) {
+	if pos+1 >= len(input) {
+		return "\\", 1, false
+	}
+
+	simpleEscapes := map[byte]string{
+		'a': "\a", 'b': "\b", 'e': "\x1b", 'E': "\x1b", 'f': "\f",
+		'n': "\n", 'r': "\r", 't': "\t", 'v': "\v", '\\': "\\",
+	}
+
+	char := input[pos+1]
+	if expanded, ok := simpleEscapes[char]; ok {
+		return expanded, 2, false
+	}
+
+	switch char {
+	case 'c':
+		return "", 2, true
+	case 'x':
+		value, digits := parseDigits(input[pos+2:], 16, 2)
+		if digits > 0 {
+			return string([]byte{byte(value)}), 2 + digits, false
+		}
+	case 'u', 'U':
+		maxDigits := 4
+		if char == 'U' {
+			maxDigits = 8
+		}
+		value, digits := parseDigits(input[pos+2:], 16, maxDigits)
+		if digits > 0 {
+			return string(rune(value)), 2 + digits, false
+		}
+	case '0', '1', '2', '3', '4', '5', '6', '7':
+		start := pos + 1
+		if echoStyle {
+			if char != '0' {
+				break
+			}
+			start++
+		}
+		value, digits := parseDigits(input[start:], 8, 3)
+		return string([]byte{byte(value)}), start - pos + digits, false
+	}
+
+	// Unknown escapes are kept as written
+	return input[pos : pos+2], 2, false
+}
+
+// parseDigits parses up to maxDigits leading digits of input in base
+func parseDigits(input string, base int, maxDigits int) (int64, int) {
+	digits := 0
+	for digits < maxDigits && digits < len(input) {
+		if _, err := strconv.ParseInt(input[digits:digits+1], base, 64); err != nil {
+			break
+		}
+		digits++
+	}
+	if digits == 0 {
+		return 0, 0
+	}
+
+	value, _ := strconv.ParseInt(input[:digits], base, 64)
+	return value, digits
+}
+
+func handlePrintfCmd(args []string) {
+	varName := ""
+	if len(args) > 0 && args[0] == "-v" {
+		if len(args) < 2 || !isValidVarName(args[1]) {
+			fmt.Fprintln(os.Stderr, "printf: -v: option requires a valid variable name")
+			lastExitStatus = 2
+			return
+		}
+		varName = args[1]
+		args = args[2:]
+	}
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "printf: usage: printf [-v var] format [arguments]")
+		lastExitStatus = 2
+		return
+	}
+
+	formatter := printfFormatter{args: args[1:]}
+	output := formatter.format(args[0])
+
+	if varName != "" {
+		setVar(varName, output)
+	} else {
+		fmt.Print(output)
+	}
+
+	if formatter.failed {
+		lastExitStatus = 1
+	}
+}
+
+type printfFormatter struct {
+	args    []string
+	argPos  int
+	stopped bool // set by \c in a %b argument
+	failed  bool // an argument was not a valid number
+}
+
+// format applies the format string, reusing it for as long as it keeps
+// consuming arguments
+func (f *printfFormatter) format(format string) string {
+	var output strings.Builder
+
+	for {
+		startPos := f.argPos
+		output.WriteString(f.formatOnce(format))
+
+		if f.stopped || f.argPos >= len(f.args) || f.argPos == startPos {
+			break
+		}
+	}
+
+	return output.String()
+}
+
+// nextArg returns the next argument, or "" once they run out
+func (f *printfFormatter) nextArg() string {
+	if f.argPos >= len(f.args) {
+		return ""
+	}
+	f.argPos++
+	return f.args[f.argPos-1]
+}
+
+func (f *printfFormatter) formatOnce(format string) string {
+	var output strings.Builder
+
+	for i := 0; i < len(format) && !f.stopped; i++ {
+		char := format[i]
+
+		switch char {
+		case backslash:
+			expanded, consumed, stop := expandEscapeAt(format, i, false)
+			if stop {
+				f.stopped = true
+				break
+			}
+			output.WriteString(expanded)
+			i += consumed - 1
+
+		case '%':
+			formatted, end := f.parseSpec(format, i+1)
+			output.WriteString(formatted)
+			i = end
+
+		default:
+			output.WriteByte(char)
+		}
+	}
+
+	return output.String()
+}
+
+// parseSpec formats the conversion whose flags start at pos and returns the
+// formatted text and the index of the conversion character
+func (f *printfFormatter) parseSpec(format string, pos int) (string, int) {
+	i := pos
+	flags := ""
+	for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+		flags += string(format[i])
+		i++
+	}
+
+	width, i := f.parseNumberOrStar(format, i)
+
+	precision := ""
+	if i < len(format) && format[i] == '.' {
+		precision, i = f.parseNumberOrStar(format, i+1)
+		precision = "." + precision
+	}
+
+	if i >= len(format) {
+		return "%" + format[pos:], len(format) - 1
+	}
+
+	spec := "%" + flags + width + precision
+	verb := format[i]
+
+	switch verb {
+	case '%':
+		return "%", i
+	case 'd', 'i':
+		arg := f.nextArg()
+		return fmt.Sprintf(spec+"d", f.toInt(arg)), i
+	case 'o', 'x', 'X':
+		arg := f.nextArg()
+		return fmt.Sprintf(spec+string(verb), uint64(f.toInt(arg))), i
+	case 'u':
+		arg := f.nextArg()
+		return fmt.Sprintf(spec+"d", uint64(f.toInt(arg))), i
+	case 'f', 'F', 'e', 'E', 'g', 'G':
+		arg := f.nextArg()
+		if verb == 'F' {
+			verb = 'f' // fmt has no %F
+		}
+		return fmt.Sprintf(spec+string(verb), f.toFloat(arg)), i
+	case 'c':
+		arg := f.nextArg()
+		// The first character, not the first byte
+		_, n := utf8.DecodeRuneInString(arg)
+		arg = arg[:n]
+		return fmt.Sprintf(spec+"s", arg), i
+	case 's':
+		arg := f.nextArg()
+		return fmt.Sprintf(spec+"s", arg), i
+	case 'b':
+		arg := f.nextArg()
+		expanded, stop := expandBackslashEscapes(arg, true)
+		if stop {
+			f.stopped = true
+		}
+		return fmt.Sprintf(spec+"s", expanded), i
+	case 'q':
+		arg := f.nextArg()
+		return fmt.Sprintf(spec+"s", shellQuote(arg)), i
+	}
+
+	fmt.Fprintf(os.Stderr, "printf: %%%c: invalid format character\n", verb)
+	f.failed = true
+	return "", i
+}
+
+// parseNumberOrStar reads a width or precision, taking it from the next
+// argument when written as '*'
+func (f *printfFormatter) parseNumberOrStar(format string, pos int) (string, int) {
+	if pos < len(format) && format[pos] == '*' {
+		arg := f.nextArg()
+		return strconv.FormatInt(f.toInt(arg), 10), pos + 1
+	}
+
+	end := pos
+	for end < len(format) && format[end] >= '0' && format[end] <= '9' {
+		end++
+	}
+	return format[pos:end], end
+}
+
+func (f *printfFormatter) toInt(arg string) int64 {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0
+	}
+
+	// 'c or "c gives the character code
+	if arg[0] == singleQuote || arg[0] == doubleQuote {
+		if len(arg) < 2 {
+			return 0
+		}
+		char, _ := utf8.DecodeRuneInString(arg[1:])
+		return int64(char)
+	}
+
+	value, err := strconv.ParseInt(arg, 0, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "printf: %s: invalid number\n", arg)
+		f.failed = true
+		return 0
+	}
+	return value
+}
+
+func (f *printfFormatter) toFloat(arg string) float64 {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return 0
+	}
+	if arg[0] == singleQuote || arg[0] == doubleQuote {
+		return float64(f.toInt(arg))
+	}
+
+	value, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "printf: %s: invalid number\n", arg)
+		f.failed = true
+		return 0
+	}
+	return value
+}
+
+// shellQuote quotes value so the shell reads it back as a single word
+func shellQuote(value string) string {
+	if value == "" {
+		return "''"
+	}
+
+	hasControl := false
+	for _, char := range value {
+		if char < 32 || char == 127 {
+			hasControl = true
+			break
+		}
+	}
+
+	if hasControl {
+		quoted := strconv.Quote(value)
+		quoted = strings.ReplaceAll(quoted[1:len(quoted)-1], "'", "\\'")
+		return "$'" + strings.ReplaceAll(quoted, "\\\"", "\"") + "'"
+	}
+
+	var result strings.Builder
+	for _, char := range value {
+		if strings.ContainsRune(" \t!\"#$&'()*,;<=>?[\\]^`{|}~", char) {
+			result.WriteByte(backslash)
+		}
+		result.WriteRune(char)
+	}
+	return result.String()
+}
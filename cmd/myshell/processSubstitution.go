@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// firstExtraFd is the descriptor the child sees for ExtraFiles[0]
+const firstExtraFd = 3
+
+type ProcessSubstitution struct {
+	Output   bool   // >(cmd) rather than <(cmd)
+	Body     string // command run by the substituted shell
+	Text     string // the literal `<(cmd)` as typed, replaced in Args
+	ArgIndex int    // index into Args of the word containing Text
+}
+
+func isProcessSubstitution(input string, pos int) bool {
+	return pos+1 < len(input) && input[pos+1] == subshellOpen
+}
+
+// parseProcessSubstitution reads the `<(...)` or `>(...)` starting at pos and
+// returns the index of its closing ')'.
+func parseProcessSubstitution(input string, pos int, argIndex int) (ProcessSubstitution, int, error) {
+	end := findGroupEnd(input[pos+1:])
+	if end == -1 {
+		return ProcessSubstitution{}, 0, fmt.Errorf("syntax error: missing ')' in process substitution")
+	}
+
+	closeIndex := pos + 1 + end
+	return ProcessSubstitution{
+		Output:   input[pos] == redirOut,
+		Body:     strings.TrimSpace(input[pos+2 : closeIndex]),
+		Text:     input[pos : closeIndex+1],
+		ArgIndex: argIndex,
+	}, closeIndex, nil
+}
+
+// startSubstitutedProcess runs substitution.Body in a child shell connected
+// through a pipe and returns the end of the pipe the main command uses. The
+// returned func waits for the child and must be called after that end is
+// closed.
+func startSubstitutedProcess(substitution ProcessSubstitution) (*os.File, func(), error) {
+	selfPath, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proc := exec.Command(selfPath, "-c", substitutionScript(substitution.Body))
+	proc.Stderr = os.Stderr
+
+	// substEnd belongs to the substituted process, mainEnd to the command
+	substEnd, mainEnd := writer, reader
+	if substitution.Output {
+		substEnd, mainEnd = reader, writer
+		proc.Stdin = reader
+		proc.Stdout = os.Stdout
+	} else {
+		proc.Stdout = writer
+	}
+
+	if err := proc.Start(); err != nil {
+		reader.Close()
+		writer.Close()
+		return nil, nil, err
+	}
+	substEnd.Close()
+
+	return mainEnd, func() { proc.Wait() }, nil
+}
+
+// substitutionScript puts declarations of the shell's variables before
+// body, as the child shell only inherits those that are exported
+func substitutionScript(body string) string {
+	names := slices.Sorted(maps.Keys(shellVars))
+
+	lines := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		lines = append(lines, formatDeclaration(name, shellVars[name]))
+	}
+	return strings.Join(append(lines, body), "\n")
+}
+
+// startProcessSubstitutions starts every <(cmd)/>(cmd) of cmd and returns
+// the args with each substitution replaced by a /dev/fd path.
+//
+// For an external command the pipe ends are returned to be passed as
+// ExtraFiles; builtins read our own descriptor instead. The returned func
+// must be called once the main command has finished: it closes our ends
+// and waits for the substituted processes.
+func startProcessSubstitutions(cmd *ParsedCommand, forChild bool) ([]string, []*os.File, func(), error) {
+	args := slices.Clone(cmd.Args)
+	var extraFiles []*os.File
+	var mainEnds []*os.File
+	var waits []func()
+
+	finish := func() {
+		for _, file := range mainEnds {
+			file.Close()
+		}
+		for _, wait := range waits {
+			wait()
+		}
+	}
+
+	for _, substitution := range cmd.ProcSubsts {
+		mainEnd, wait, err := startSubstitutedProcess(substitution)
+		if err != nil {
+			finish()
+			return nil, nil, nil, err
+		}
+		mainEnds = append(mainEnds, mainEnd)
+		waits = append(waits, wait)
+
+		fd := int(mainEnd.Fd())
+		if forChild {
+			fd = firstExtraFd + len(extraFiles)
+			extraFiles = append(extraFiles, mainEnd)
+		}
+
+		if substitution.ArgIndex >= 0 && substitution.ArgIndex < len(args) {
+			path := fmt.Sprintf("/dev/fd/%d", fd)
+			args[substitution.ArgIndex] = strings.Replace(args[substitution.ArgIndex], substitution.Text, path, 1)
+		}
+	}
+
+	return args, extraFiles, finish, nil
+}
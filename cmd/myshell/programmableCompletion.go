@@ -0,0 +1,497 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const completeUsage = "complete: usage: complete [-abcdefprv] [-o option] [-A action] [-W wordlist] [-F function] [-C command] [-X filterpat] [-P prefix] [-S suffix] [name ...]"
+
+const compgenUsage = "compgen: usage: compgen [-abcdefv] [-o option] [-A action] [-W wordlist] [-F function] [-C command] [-X filterpat] [-P prefix] [-S suffix] [word]"
+
+// completionSpec says how the arguments of a command are completed. It is
+// registered with `complete` and used by tryAutoComplete and `compgen`.
+type completionSpec struct {
+	actions  []string // -A actions, including those given as -f, -d, ...
+	wordList string   // -W, split and expanded each time it is used
+	function string   // -F, a shell function that fills COMPREPLY
+	command  string   // -C
+	filter   string   // -X, matches are removed, or kept with a leading !
+	prefix   string   // -P
+	suffix   string   // -S
+	options  []string // -o
+}
+
+// completionSpecs holds the specs registered with `complete`, by command
+var completionSpecs = map[string]*completionSpec{}
+
+// completionActionFlags are the letters that stand for -A actions
+var completionActionFlags = map[byte]string{
+	'a': "alias",
+	'b': "builtin",
+	'c': "command",
+	'd': "directory",
+	'e': "export",
+	'f': "file",
+	'v': "variable",
+}
+
+var completionActions = []string{"alias", "builtin", "command", "directory", "export", "file", "function", "variable"}
+
+var completionOptions = []string{"bashdefault", "default", "dirnames", "filenames", "noquote", "nospace", "plusdirs"}
+
+// completeFlags are the options of `complete` that are not part of a spec
+type completeFlags struct {
+	print  bool // -p
+	remove bool // -r
+}
+
+// parseCompletionSpec reads the options shared by complete and compgen.
+// It returns the spec and the names or word after the options.
+func parseCompletionSpec(args []string) (*completionSpec, completeFlags, []string, error) {
+	spec := &completionSpec{}
+	var flags completeFlags
+
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || len(arg) == 1 {
+			break
+		}
+
+		for j := 1; j < len(arg); j++ {
+			flag := arg[j]
+			if action, ok := completionActionFlags[flag]; ok {
+				spec.actions = append(spec.actions, action)
+				continue
+			}
+
+			switch flag {
+			case 'p':
+				flags.print = true
+				continue
+			case 'r':
+				flags.remove = true
+				continue
+			}
+
+			if strings.IndexByte("oAWFCXPS", flag) < 0 {
+				return nil, flags, nil, fmt.Errorf("-%c: invalid option", flag)
+			}
+
+			// The value is the rest of the argument, or the next one
+			value := arg[j+1:]
+			if value == "" {
+				i++
+				if i >= len(args) {
+					return nil, flags, nil, fmt.Errorf("-%c: option requires an argument", flag)
+				}
+				value = args[i]
+			}
+			j = len(arg)
+
+			switch flag {
+			case 'o':
+				if !slices.Contains(completionOptions, value) {
+					return nil, flags, nil, fmt.Errorf("%s: invalid option name", value)
+				}
+				spec.options = append(spec.options, value)
+			case 'A':
+				if !slices.Contains(completionActions, value) {
+					return nil, flags, nil, fmt.Errorf("%s: invalid action name", value)
+				}
+				spec.actions = append(spec.actions, value)
+			case 'W':
+				spec.wordList = value
+			case 'F':
+				spec.function = value
+			case 'C':
+				spec.command = value
+			case 'X':
+				spec.filter = value
+			case 'P':
+				spec.prefix = value
+			case 'S':
+				spec.suffix = value
+			}
+		}
+	}
+
+	return spec, flags, args[i:], nil
+}
+
+func handleCompleteCmd(args []string) {
+	spec, flags, names, err := parseCompletionSpec(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "complete: %v\n", err)
+		fmt.Fprintln(os.Stderr, completeUsage)
+		lastExitStatus = 2
+		return
+	}
+
+	switch {
+	case flags.remove && len(names) == 0:
+		clear(completionSpecs)
+
+	case flags.remove:
+		for _, name := range names {
+			if _, ok := completionSpecs[name]; !ok {
+				fmt.Fprintf(os.Stderr, "complete: %s: no completion specification\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			delete(completionSpecs, name)
+		}
+
+	case flags.print || len(names) == 0:
+		if len(names) == 0 {
+			for name := range completionSpecs {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+		}
+
+		for _, name := range names {
+			registered, ok := completionSpecs[name]
+			if !ok {
+				fmt.Fprintf(os.Stderr, "complete: %s: no completion specification\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			fmt.Println(registered.format(name))
+		}
+
+	default:
+		for _, name := range names {
+			completionSpecs[name] = spec
+		}
+	}
+}
+
+// handleCompgenCmd prints the matches of word for the options, one per
+// line, as completing it would offer them
+func handleCompgenCmd(args []string) {
+	spec, flags, rest, err := parseCompletionSpec(args)
+	switch {
+	case err != nil:
+	case flags.print:
+		err = fmt.Errorf("-p: invalid option")
+	case flags.remove:
+		err = fmt.Errorf("-r: invalid option")
+	case len(rest) > 1:
+		err = fmt.Errorf("too many arguments")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compgen: %v\n", err)
+		fmt.Fprintln(os.Stderr, compgenUsage)
+		lastExitStatus = 2
+		return
+	}
+
+	word := ""
+	if len(rest) == 1 {
+		word = rest[0]
+	}
+	ctx := completionContext{line: word, cursor: len(word), word: word, words: []string{word}}
+
+	matches, err := spec.candidates(ctx, word)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compgen: %v\n", err)
+	}
+	for _, match := range matches {
+		fmt.Println(match)
+	}
+	if len(matches) == 0 {
+		lastExitStatus = 1
+	}
+}
+
+// completionSpecFor returns the spec registered for a command, by its
+// name as typed or, for a path, by its base name
+func completionSpecFor(name string) *completionSpec {
+	if name == "" {
+		return nil
+	}
+	if spec, ok := completionSpecs[name]; ok {
+		return spec
+	}
+	return completionSpecs[filepath.Base(name)]
+}
+
+// format renders the spec as the `complete` command that registers it
+func (spec *completionSpec) format(name string) string {
+	parts := []string{"complete"}
+	for _, option := range spec.options {
+		parts = append(parts, "-o", option)
+	}
+
+	for _, action := range spec.actions {
+		flag := "-A " + action
+		for letter, name := range completionActionFlags {
+			if name == action {
+				flag = "-" + string(letter)
+			}
+		}
+		parts = append(parts, flag)
+	}
+
+	for _, option := range []struct {
+		flag  string
+		value string
+	}{
+		{"-W", spec.wordList},
+		{"-X", spec.filter},
+		{"-P", spec.prefix},
+		{"-S", spec.suffix},
+		{"-C", spec.command},
+	} {
+		if option.value != "" {
+			parts = append(parts, option.flag, singleQuoteWord(option.value))
+		}
+	}
+	if spec.function != "" {
+		parts = append(parts, "-F", spec.function)
+	}
+
+	return strings.Join(append(parts, name), " ")
+}
+
+func (spec *completionSpec) hasOption(name string) bool {
+	return slices.Contains(spec.options, name)
+}
+
+// completions returns the candidates for the word being completed, quoted
+// for the line. When the spec finds nothing, -o default and -o dirnames
+// fall back to file and directory names.
+func (spec *completionSpec) completions(ctx completionContext) ([]completion, error) {
+	word := unquoteCompletion(ctx.word)
+	candidates, err := spec.candidates(ctx, word)
+
+	isFiles := spec.hasOption("filenames") || slices.Contains(spec.actions, "file") || slices.Contains(spec.actions, "directory")
+	switch {
+	case len(candidates) == 0 && spec.hasOption("dirnames"):
+		candidates = matchFiles(word, true)
+		isFiles = true
+	case len(candidates) == 0 && (spec.hasOption("default") || spec.hasOption("bashdefault")):
+		candidates = matchFiles(word, false)
+		isFiles = true
+	}
+	if spec.hasOption("plusdirs") {
+		candidates = append(candidates, matchFiles(word, true)...)
+	}
+
+	slices.Sort(candidates)
+	candidates = slices.Compact(candidates)
+
+	matches := make([]completion, 0, len(candidates))
+	for _, candidate := range candidates {
+		// -C commands may describe a candidate after a tab
+		candidate, description, _ := strings.Cut(candidate, "\t")
+
+		match := completion{text: escapeCompletion(candidate), display: candidate, description: description}
+		if isFiles {
+			match = fileCompletion(candidate)
+		}
+		if spec.hasOption("noquote") {
+			match.text = candidate
+		}
+		match.noSpace = match.noSpace || spec.hasOption("nospace")
+		matches = append(matches, match)
+	}
+	return matches, err
+}
+
+// candidates generates the unquoted matches for word. The actions and -W
+// words are those starting with word; -C output is used as it is.
+func (spec *completionSpec) candidates(ctx completionContext, word string) ([]string, error) {
+	var candidates []string
+	for _, action := range spec.actions {
+		candidates = append(candidates, completionActionMatches(action, word)...)
+	}
+
+	if spec.wordList != "" {
+		words, err := splitWords(spec.wordList)
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range words.words {
+			if strings.HasPrefix(candidate, word) {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	var errs []error
+	if spec.function != "" {
+		reply, err := runCompletionFunction(spec.function, ctx, word)
+		candidates = append(candidates, reply...)
+		errs = append(errs, err)
+	}
+	if spec.command != "" {
+		output, err := runCompletionCommand(spec.command, ctx, word)
+		candidates = append(candidates, output...)
+		errs = append(errs, err)
+	}
+
+	if spec.filter != "" {
+		pattern, keep := spec.filter, false
+		if strings.HasPrefix(pattern, "!") {
+			pattern, keep = pattern[1:], true
+		}
+		// & in the pattern stands for the word being completed
+		pattern = strings.ReplaceAll(pattern, "&", word)
+
+		candidates = slices.DeleteFunc(candidates, func(candidate string) bool {
+			return globMatch(pattern, candidate) != keep
+		})
+	}
+
+	for i, candidate := range candidates {
+		name, description, hasDescription := strings.Cut(candidate, "\t")
+		candidates[i] = spec.prefix + name + spec.suffix
+		if hasDescription {
+			candidates[i] += "\t" + description
+		}
+	}
+	return candidates, errors.Join(errs...)
+}
+
+// completionActionMatches returns the names of a kind starting with word
+func completionActionMatches(action string, word string) []string {
+	var names []string
+	switch action {
+	case "file":
+		return matchFiles(word, false)
+	case "directory":
+		return matchFiles(word, true)
+	case "builtin":
+		names = builtInCommands
+	case "command":
+		names = append(slices.Clone(builtInCommands), pathExecutables(word)...)
+	case "variable":
+		for name := range shellVars {
+			names = append(names, name)
+		}
+		fallthrough
+	case "export":
+		for _, variable := range os.Environ() {
+			name, _, _ := strings.Cut(variable, "=")
+			names = append(names, name)
+		}
+	case "alias":
+		for name := range shellAliases {
+			names = append(names, name)
+		}
+	case "function":
+		for name := range shellFunctions {
+			names = append(names, name)
+		}
+	}
+
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, word) {
+			matches = append(matches, name)
+		}
+	}
+	slices.Sort(matches)
+	return slices.Compact(matches)
+}
+
+// runCompletionFunction calls a -F function as bash does, with the command
+// name, the word being completed and the word before it as arguments and
+// COMP_WORDS, COMP_CWORD, COMP_LINE and COMP_POINT set. The candidates are
+// what it leaves in COMPREPLY. The variables are put back afterwards.
+func runCompletionFunction(name string, ctx completionContext, word string) ([]string, error) {
+	if !isFunction(name) {
+		return nil, fmt.Errorf("function `%s' not found", name)
+	}
+
+	compWords := newIndexedArray()
+	for i, compWord := range ctx.words {
+		compWords.Indexed[i] = compWord
+	}
+	compVars := map[string]*Variable{
+		"COMP_WORDS": compWords,
+		"COMP_CWORD": {Value: strconv.Itoa(ctx.wordIndex)},
+		"COMP_LINE":  {Value: ctx.line},
+		"COMP_POINT": {Value: strconv.Itoa(ctx.cursor)},
+		"COMPREPLY":  newIndexedArray(),
+	}
+
+	saved := make(map[string]*Variable, len(compVars))
+	for varName, variable := range compVars {
+		if old, ok := shellVars[varName]; ok {
+			saved[varName] = old
+		}
+		shellVars[varName] = variable
+	}
+	status := lastExitStatus
+	defer func() {
+		for varName := range compVars {
+			delete(shellVars, varName)
+			if old, ok := saved[varName]; ok {
+				shellVars[varName] = old
+			}
+		}
+		lastExitStatus = status
+	}()
+
+	runFunction(name, []string{ctx.commandName(), word, ctx.previousWord()})
+
+	if reply := getVariable("COMPREPLY"); reply != nil {
+		return reply.values(), nil
+	}
+	return nil, nil
+}
+
+// runCompletionCommand runs a -C command as bash does, with the command
+// name, the word being completed and the word before it as arguments and
+// COMP_LINE and COMP_POINT in its environment. Each line it prints is a
+// candidate, which may be followed by a tab and a description.
+func runCompletionCommand(command string, ctx completionContext, word string) ([]string, error) {
+	shell, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	line := strings.Join([]string{command, singleQuoteWord(ctx.commandName()), singleQuoteWord(word), singleQuoteWord(ctx.previousWord())}, " ")
+
+	cmd := exec.Command(shell, "-c", line)
+	cmd.Env = append(os.Environ(),
+		"COMP_LINE="+ctx.line,
+		"COMP_POINT="+strconv.Itoa(ctx.cursor),
+		"COMP_CWORD="+strconv.Itoa(ctx.wordIndex),
+		"COMP_TYPE=9",
+		"COMP_KEY=9",
+	)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", command, err)
+	}
+
+	var candidates []string
+	for _, candidate := range strings.Split(string(output), "\n") {
+		if candidate != "" {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, nil
+}
+
+// singleQuoteWord quotes s so the shell reads it back unchanged
+func singleQuoteWord(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+type readOptions struct {
+	raw       bool // -r: backslash does not escape
+	silent    bool // -s: do not echo terminal input
+	prompt    string
+	timeout   time.Duration // -t, 0 means wait forever
+	poll      bool          // -t 0: only report whether there is input
+	maxChars  int           // -n in characters, -1 means no limit
+	delim     byte
+	arrayName string
+	names     []string
+}
+
+// readResult statuses mirror bash: 1 on EOF, > 128 on timeout
+const (
+	readTimeoutStatus = 142
+	readUsageStatus   = 2
+)
+
+func handleReadCmd(args []string) {
+	opts, err := parseReadOptions(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "read: %v\n", err)
+		fmt.Fprintln(os.Stderr, "read: usage: read [-rs] [-a array] [-d delim] [-n nchars] [-p prompt] [-t timeout] [name ...]")
+		lastExitStatus = readUsageStatus
+		return
+	}
+
+	fd := int(os.Stdin.Fd())
+	isTerminal := term.IsTerminal(fd)
+
+	if opts.poll {
+		lastExitStatus = 1
+		if inputAvailable(fd) {
+			lastExitStatus = 0
+		}
+		return
+	}
+
+	if opts.prompt != "" && isTerminal {
+		fmt.Fprint(os.Stderr, opts.prompt)
+	}
+
+	line, escaped, status := readInput(opts, fd, isTerminal)
+
+	switch {
+	case opts.arrayName != "":
+		setArrayVar(opts.arrayName, splitReadFields(line, escaped, getIFS(), 0))
+	case len(opts.names) == 0:
+		setVar("REPLY", string(line))
+	default:
+		fields := splitReadFields(line, escaped, getIFS(), len(opts.names))
+		for i, name := range opts.names {
+			value := ""
+			if i < len(fields) {
+				value = fields[i]
+			}
+			setVar(name, value)
+		}
+	}
+
+	lastExitStatus = status
+}
+
+func parseReadOptions(args []string) (readOptions, error) {
+	opts := readOptions{maxChars: -1, delim: '\n'}
+
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+
+		for j := 1; j < len(arg); j++ {
+			flag := arg[j]
+
+			switch flag {
+			case 'r':
+				opts.raw = true
+				continue
+			case 's':
+				opts.silent = true
+				continue
+			case 'p', 't', 'n', 'd', 'a':
+			default:
+				return opts, fmt.Errorf("-%c: invalid option", flag)
+			}
+
+			// The remaining options take a value, either attached or as the next arg
+			value := arg[j+1:]
+			if value == "" {
+				i++
+				if i >= len(args) {
+					return opts, fmt.Errorf("-%c: option requires an argument", flag)
+				}
+				value = args[i]
+			}
+
+			switch flag {
+			case 'p':
+				opts.prompt = value
+			case 't':
+				seconds, err := strconv.ParseFloat(value, 64)
+				if err != nil || seconds < 0 {
+					return opts, fmt.Errorf("%s: invalid timeout specification", value)
+				}
+				opts.timeout = time.Duration(seconds * float64(time.Second))
+				opts.poll = seconds == 0
+			case 'n':
+				count, err := strconv.Atoi(value)
+				if err != nil || count < 0 {
+					return opts, fmt.Errorf("%s: invalid number", value)
+				}
+				opts.maxChars = count
+			case 'd':
+				opts.delim = 0 // an empty delimiter means NUL
+				if value != "" {
+					opts.delim = value[0]
+				}
+			case 'a':
+				if !isValidVarName(value) {
+					return opts, fmt.Errorf("`%s': not a valid identifier", value)
+				}
+				opts.arrayName = value
+			}
+			break
+		}
+	}
+
+	for _, name := range args[i:] {
+		if !isValidVarName(name) {
+			return opts, fmt.Errorf("`%s': not a valid identifier", name)
+		}
+		opts.names = append(opts.names, name)
+	}
+
+	return opts, nil
+}
+
+// readInput reads one record from stdin byte by byte, so nothing past the
+// delimiter is consumed from a pipe. escaped marks bytes that were preceded
+// by a backslash and therefore never split fields.
+func readInput(opts readOptions, fd int, isTerminal bool) ([]byte, []bool, int) {
+	var line []byte
+	var escaped []bool
+
+	// A cooked terminal only hands over complete lines, so switch to raw
+	// mode whenever we need to see individual keys or hide them
+	useRawMode := isTerminal && (opts.silent || opts.maxChars >= 0 || opts.delim != '\n')
+	if useRawMode {
+		oldState, err := term.MakeRaw(fd)
+		if err == nil {
+			defer term.Restore(fd, oldState)
+		} else {
+			useRawMode = false
+		}
+	}
+
+	echo := func(text string) {
+		if useRawMode && !opts.silent {
+			fmt.Fprint(os.Stderr, text)
+		}
+	}
+
+	var deadline time.Time
+	if opts.timeout > 0 {
+		deadline = time.Now().Add(opts.timeout)
+	}
+
+	escapeNext := false
+	for opts.maxChars < 0 || !hasChars(line, opts.maxChars) {
+		if !deadline.IsZero() && !waitForInput(fd, deadline) {
+			return line, escaped, readTimeoutStatus
+		}
+
+		var buf [1]byte
+		n, err := os.Stdin.Read(buf[:])
+		if err != nil || n == 0 {
+			return line, escaped, 1
+		}
+		char := buf[0]
+
+		if useRawMode {
+			switch char {
+			case '\r':
+				char = '\n'
+			case 3: // Ctrl+C
+				echo("\r\n")
+				return nil, nil, 130
+			case 4: // Ctrl+D
+				if len(line) == 0 {
+					return line, escaped, 1
+				}
+				continue
+			case 127, 8: // Backspace
+				if len(line) > 0 {
+					_, size := utf8.DecodeLastRune(line)
+					line = line[:len(line)-size]
+					escaped = escaped[:len(escaped)-size]
+					echo("\b \b")
+				}
+				continue
+			}
+		}
+
+		if escapeNext {
+			escapeNext = false
+			if char == '\n' {
+				// Backslash-newline continues the line
+				echo("\r\n")
+				continue
+			}
+			line = append(line, char)
+			escaped = append(escaped, true)
+			echo(string(char))
+			continue
+		}
+
+		if char == opts.delim {
+			if char == '\n' {
+				echo("\r\n")
+			}
+			break
+		}
+
+		if char == backslash && !opts.raw {
+			escapeNext = true
+			echo(string(char))
+			continue
+		}
+
+		line = append(line, char)
+		escaped = append(escaped, false)
+		echo(string(char))
+	}
+
+	return line, escaped, 0
+}
+
+// hasChars reports whether line holds n whole characters, so that read -n
+// does not stop in the middle of a multibyte one
+func hasChars(line []byte, n int) bool {
+	if len(line) == 0 {
+		return n <= 0
+	}
+
+	// The last character may still be missing some of its bytes
+	last := len(line) - 1
+	for last > 0 && len(line)-last < utf8.UTFMax && !utf8.RuneStart(line[last]) {
+		last--
+	}
+	count := utf8.RuneCount(line[:last])
+	if utf8.FullRune(line[last:]) {
+		count++
+	}
+	return count >= n
+}
+
+// inputAvailable reports whether reading fd would not block, which is also
+// the case at end of file
+func inputAvailable(fd int) bool {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err == nil && n > 0
+}
+
+// waitForInput blocks until fd is readable or the deadline passes
+func waitForInput(fd int, deadline time.Time) bool {
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(remaining.Milliseconds())+1)
+		if err == unix.EINTR {
+			continue
+		}
+		return err == nil && n > 0
+	}
+}
+
+// splitReadFields splits line on IFS the way read does: runs of IFS
+// whitespace separate fields and are trimmed from both ends, while every
+// other IFS character delimits exactly one field. When maxFields > 0 the
+// last field receives the rest of the line.
+func splitReadFields(line []byte, escaped []bool, ifs string, maxFields int) []string {
+	isSeparator := func(i int) bool {
+		return !escaped[i] && strings.IndexByte(ifs, line[i]) >= 0
+	}
+	isSpaceSeparator := func(i int) bool {
+		return isSeparator(i) && strings.IndexByte(defaultIFS, line[i]) >= 0
+	}
+
+	start, end := 0, len(line)
+	for start < end && isSpaceSeparator(start) {
+		start++
+	}
+	for end > start && isSpaceSeparator(end-1) {
+		end--
+	}
+
+	var fields []string
+	for i := start; i < end; {
+		if maxFields > 0 && len(fields) == maxFields-1 {
+			return append(fields, string(line[i:end]))
+		}
+
+		fieldStart := i
+		for i < end && !isSeparator(i) {
+			i++
+		}
+		fields = append(fields, string(line[fieldStart:i]))
+
+		for i < end && isSpaceSeparator(i) {
+			i++
+		}
+		if i < end && isSeparator(i) {
+			i++
+			for i < end && isSpaceSeparator(i) {
+				i++
+			}
+		}
+	}
+
+	return fields
+}
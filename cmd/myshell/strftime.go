@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// formatStrftime formats t using the C strftime conversions that
+// HISTTIMEFORMAT is written in. Unknown conversions are copied as is.
+func formatStrftime(t time.Time, format string) string {
+	var out strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 >= len(format) {
+			out.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&out, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&out, "%02d", t.Year()%100)
+		case 'C':
+			fmt.Fprintf(&out, "%02d", t.Year()/100)
+		case 'm':
+			fmt.Fprintf(&out, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&out, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&out, "%2d", t.Day())
+		case 'j':
+			fmt.Fprintf(&out, "%03d", t.YearDay())
+		case 'H':
+			fmt.Fprintf(&out, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&out, "%02d", (t.Hour()+11)%12+1)
+		case 'M':
+			fmt.Fprintf(&out, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&out, "%02d", t.Second())
+		case 'p':
+			out.WriteString(t.Format("PM"))
+		case 'a':
+			out.WriteString(t.Format("Mon"))
+		case 'A':
+			out.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			out.WriteString(t.Format("Jan"))
+		case 'B':
+			out.WriteString(t.Format("January"))
+		case 'u':
+			fmt.Fprintf(&out, "%d", (int(t.Weekday())+6)%7+1)
+		case 'w':
+			fmt.Fprintf(&out, "%d", int(t.Weekday()))
+		case 'Z':
+			out.WriteString(t.Format("MST"))
+		case 'z':
+			out.WriteString(t.Format("-0700"))
+		case 's':
+			fmt.Fprintf(&out, "%d", t.Unix())
+		case 'F':
+			out.WriteString(t.Format("2006-01-02"))
+		case 'T':
+			out.WriteString(t.Format("15:04:05"))
+		case 'R':
+			out.WriteString(t.Format("15:04"))
+		case 'D':
+			out.WriteString(t.Format("01/02/06"))
+		case 'c':
+			out.WriteString(t.Format("Mon Jan _2 15:04:05 2006"))
+		case 'x':
+			out.WriteString(t.Format("01/02/06"))
+		case 'X':
+			out.WriteString(t.Format("15:04:05"))
+		case 'n':
+			out.WriteByte('\n')
+		case 't':
+			out.WriteByte('\t')
+		case '%':
+			out.WriteByte('%')
+		default:
+			out.WriteByte('%')
+			out.WriteByte(format[i])
+		}
+	}
+
+	return out.String()
+}
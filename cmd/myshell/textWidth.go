@@ -0,0 +1,202 @@
+package main
+
+import "unicode"
+
+const (
+	zeroWidthJoiner = '\u200D'
+	regionalFirst   = '\U0001F1E6'
+	regionalLast    = '\U0001F1FF'
+)
+
+// wideRanges are the East Asian wide and fullwidth blocks and the emoji
+// blocks that terminals draw two columns wide
+var wideRanges = []struct{ first, last rune }{
+	{0x1100, 0x115F},   // Hangul Jamo
+	{0x231A, 0x231B},   // watch, hourglass
+	{0x23E9, 0x23EC},   // media controls
+	{0x25FD, 0x25FE},   // small squares
+	{0x2614, 0x2615},   // umbrella, hot beverage
+	{0x2648, 0x2653},   // zodiac
+	{0x26A1, 0x26A1},   // high voltage
+	{0x26AA, 0x26AB},   // circles
+	{0x26BD, 0x26BE},   // soccer, baseball
+	{0x26C4, 0x26C5},   // snowman, sun
+	{0x26D4, 0x26D4},   // no entry
+	{0x26EA, 0x26EA},   // church
+	{0x26F2, 0x26F5},   // fountain to sailboat
+	{0x26FA, 0x26FD},   // tent to fuel pump
+	{0x2705, 0x2705},   // check mark
+	{0x270A, 0x270B},   // fists
+	{0x2728, 0x2728},   // sparkles
+	{0x274C, 0x274E},   // cross marks
+	{0x2753, 0x2757},   // question and exclamation marks
+	{0x2795, 0x2797},   // plus, minus, divide
+	{0x27B0, 0x27BF},   // loops
+	{0x2B1B, 0x2B1C},   // large squares
+	{0x2B50, 0x2B55},   // star, circle
+	{0x2E80, 0x303E},   // CJK radicals to CJK symbols
+	{0x3041, 0x33FF},   // Hiragana to CJK compatibility
+	{0x3400, 0x4DBF},   // CJK extension A
+	{0x4E00, 0x9FFF},   // CJK unified ideographs
+	{0xA000, 0xA4CF},   // Yi
+	{0xA960, 0xA97F},   // Hangul Jamo extended A
+	{0xAC00, 0xD7A3},   // Hangul syllables
+	{0xF900, 0xFAFF},   // CJK compatibility ideographs
+	{0xFE10, 0xFE19},   // vertical forms
+	{0xFE30, 0xFE6F},   // CJK compatibility forms
+	{0xFF00, 0xFF60},   // fullwidth forms
+	{0xFFE0, 0xFFE6},   // fullwidth signs
+	{0x16FE0, 0x1B2FF}, // Tangut to Nushu
+	{0x1F004, 0x1F004}, // mahjong tile
+	{0x1F0CF, 0x1F0CF}, // playing card
+	{0x1F18E, 0x1F18E}, // AB button
+	{0x1F191, 0x1F19A}, // squared words
+	{0x1F200, 0x1F251}, // enclosed ideographs
+	{0x1F300, 0x1F64F}, // pictographs and emoticons
+	{0x1F680, 0x1F6FF}, // transport and map symbols
+	{0x1F7E0, 0x1F7EB}, // coloured circles and squares
+	{0x1F90C, 0x1F9FF}, // supplemental symbols and pictographs
+	{0x1FA70, 0x1FAFF}, // symbols and pictographs extended A
+	{0x20000, 0x2FFFD}, // CJK extension B onwards
+	{0x30000, 0x3FFFD}, // CJK extension G onwards
+}
+
+// runeWidth is the number of terminal columns a rune takes on its own
+func runeWidth(char rune) int {
+	if char == 0 || isGraphemeExtend(char) || unicode.Is(unicode.Cf, char) {
+		return 0
+	}
+
+	for _, r := range wideRanges {
+		if char < r.first {
+			break
+		}
+		if char <= r.last {
+			return 2
+		}
+	}
+	return 1
+}
+
+// isGraphemeExtend reports whether char attaches to the character before
+// it: combining marks, variation selectors, emoji skin tones and tags
+func isGraphemeExtend(char rune) bool {
+	switch {
+	case unicode.In(char, unicode.Mn, unicode.Me, unicode.Mc):
+		return true
+	case char == zeroWidthJoiner:
+		return true
+	case char >= 0xFE00 && char <= 0xFE0F:
+		return true
+	case char >= 0x1F3FB && char <= 0x1F3FF:
+		return true
+	case char >= 0xE0020 && char <= 0xE007F:
+		return true
+	}
+	return false
+}
+
+// isInsertable reports whether a typed rune goes into the line: printable
+// characters, and the joiners and other format characters between them
+func isInsertable(char rune) bool {
+	return unicode.IsPrint(char) || unicode.Is(unicode.Cf, char) || isGraphemeExtend(char)
+}
+
+func isRegionalIndicator(char rune) bool {
+	return char >= regionalFirst && char <= regionalLast
+}
+
+// nextGraphemeEnd returns the end of the user-perceived character that
+// starts at pos, so a cursor never lands inside an accented letter, a
+// flag or a joined emoji sequence
+func nextGraphemeEnd(text []rune, pos int) int {
+	if pos >= len(text) {
+		return len(text)
+	}
+
+	end := pos + 1
+
+	// Two regional indicators form one flag
+	if isRegionalIndicator(text[pos]) && end < len(text) && isRegionalIndicator(text[end]) {
+		end++
+	}
+
+	for end < len(text) {
+		if isGraphemeExtend(text[end]) {
+			end++
+		} else if text[end-1] == zeroWidthJoiner {
+			end++ // the character after a joiner joins the sequence
+		} else {
+			break
+		}
+	}
+	return end
+}
+
+// previousGraphemeStart returns the start of the character that ends at pos
+func previousGraphemeStart(text []rune, pos int) int {
+	start := 0
+	for i := 0; i < pos; {
+		next := nextGraphemeEnd(text, i)
+		if next >= pos {
+			return i
+		}
+		start = next
+		i = next
+	}
+	return start
+}
+
+// graphemeWidth is the number of columns one grapheme cluster takes
+func graphemeWidth(cluster []rune) int {
+	if len(cluster) == 0 {
+		return 0
+	}
+	if isRegionalIndicator(cluster[0]) {
+		return 2
+	}
+
+	width := runeWidth(cluster[0])
+	for _, char := range cluster[1:] {
+		// VS16 asks for the emoji presentation of a narrow symbol
+		if char == 0xFE0F {
+			return 2
+		}
+	}
+	return width
+}
+
+// displayWidth is the number of terminal columns text takes
+func displayWidth(text []rune) int {
+	width := 0
+	for i := 0; i < len(text); {
+		end := nextGraphemeEnd(text, i)
+		width += graphemeWidth(text[i:end])
+		i = end
+	}
+	return width
+}
+
+// truncateToWidth cuts text to at most width columns, ending it with an
+// ellipsis when anything was cut
+func truncateToWidth(text string, width int) string {
+	runes := []rune(text)
+	if displayWidth(runes) <= width {
+		return text
+	}
+	if width < 1 {
+		return ""
+	}
+
+	end, used := 0, 0
+	for end < len(runes) {
+		next := nextGraphemeEnd(runes, end)
+		charWidth := graphemeWidth(runes[end:next])
+		if used+charWidth > width-1 {
+			break
+		}
+		used += charWidth
+		end = next
+	}
+	return string(runes[:end]) + "…"
+}
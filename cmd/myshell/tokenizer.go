@@ -0,0 +1,97 @@
+package main
+
+import "strings"
+
+// token is a word or an operator of a command line. Unlike splitWords,
+// tokenize keeps words as typed and records where they are, which the
+// line editor needs to work on the word under the cursor.
+type token struct {
+	text       string
+	start, end int // byte offsets in the line
+	isOperator bool
+}
+
+// shellOperators are matched longest first
+var shellOperators = []string{
+	"2>&1", "2>>", ">&2",
+	"&&", "||", ">>", "2>", "<(", ">(",
+	"|", "&", ";", "(", ")", "<", ">", "\n",
+}
+
+// commandSeparators are the operators after which a command starts
+var commandSeparators = map[string]bool{
+	"&&": true, "||": true, "|": true, "&": true, ";": true, "\n": true,
+	"(": true, "<(": true, ">(": true,
+}
+
+// tokenize splits a line into words and operators. Quotes and
+// backslashes stay part of the word, and an unclosed quote runs to the
+// end of the line.
+func tokenize(line string) []token {
+	var tokens []token
+
+	for i := 0; i < len(line); {
+		if line[i] == whitespace || line[i] == '\t' {
+			i++
+			continue
+		}
+
+		if operator := operatorAt(line, i); operator != "" {
+			tokens = append(tokens, token{text: operator, start: i, end: i + len(operator), isOperator: true})
+			i += len(operator)
+			continue
+		}
+
+		start := i
+		i = wordEnd(line, i)
+		tokens = append(tokens, token{text: line[start:i], start: start, end: i})
+	}
+
+	return tokens
+}
+
+// operatorAt returns the operator starting at pos, if there is one. 2> is
+// only an operator at the start of a word.
+func operatorAt(line string, pos int) string {
+	for _, operator := range shellOperators {
+		if !strings.HasPrefix(line[pos:], operator) {
+			continue
+		}
+		if operator[0] == '2' && pos > 0 && line[pos-1] != whitespace && line[pos-1] != '\t' {
+			continue
+		}
+		return operator
+	}
+	return ""
+}
+
+// wordEnd returns where the word starting at pos ends
+func wordEnd(line string, pos int) int {
+	var quote byte
+	i := pos
+	for ; i < len(line); i++ {
+		char := line[i]
+		switch {
+		case quote != 0:
+			if char == quote {
+				quote = 0
+			} else if char == backslash && quote == doubleQuote {
+				i++
+			}
+		case char == backslash:
+			i++
+		case char == singleQuote || char == doubleQuote:
+			quote = char
+		case char == subshellOpen && i > pos && line[i-1] == '=':
+			// The value list of NAME=(...) is part of the word
+			end := findGroupEnd(line[i:])
+			if end == -1 {
+				return len(line)
+			}
+			i += end
+		case char == whitespace || char == '\t' || strings.IndexByte("|&;()<>\n", char) >= 0:
+			return i
+		}
+	}
+	return min(i, len(line))
+}
@@ -1,12 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
-
-	"golang.org/x/term"
 )
 
 const (
@@ -17,7 +15,11 @@ const (
 	redirOut      = '>'
 	redirIn       = '<'
 	pathSeparator = string(os.PathListSeparator)
-	pipeline	  = '|'
+	pipeline      = '|'
+	subshellOpen  = '('
+	subshellClose = ')'
+	groupOpen     = '{'
+	groupClose    = '}'
 )
 
 type RedirectionType int
@@ -29,87 +31,249 @@ const (
 	ErrorRedirection
 	AppendOutRedirection
 	AppendErrRedirection
+	ErrToOutRedirection // 2>&1
+	OutToErrRedirection // >&2
 )
 
+type Redirection struct {
+	Type      RedirectionType
+	File      string
+	ProcSubst *ProcessSubstitution // target written as `> >(cmd)` or `< <(cmd)`
+}
+
 func parseInput(input string) ParsedCommand {
+	return parseExpandedInput(expandAliases(strings.TrimSpace(input)))
+}
+
+// parseExpandedInput is parseInput for text whose first word has already
+// been through alias expansion
+func parseExpandedInput(input string) ParsedCommand {
 	input = strings.TrimSpace(input)
 	if input == "" {
 		return ParsedCommand{}
 	}
 
 	pipeIndex := checkIfPipeStatement(input)
-    if pipeIndex != -1 {
-        leftCmd := parseInput(strings.TrimSpace(input[:pipeIndex]))
-        rightCmd := parseInput(strings.TrimSpace(input[pipeIndex+1:]))
-        
-        leftCmd.PipedCmd = &rightCmd
-        return leftCmd
-    }
-
-	redirType := NoRedirection
-	redirFile := ""
-	for i := range len(input) {
-		if input[i] == redirOut || input[i] == redirIn {
-			leftInput, err := processRedirection(input, i, &redirType, &redirFile)
-			if err != nil {
-				fmt.Printf("Error processing redirection: %v\n", err)
-				return ParsedCommand{}
-			}
-			input = leftInput
+	if pipeIndex != -1 {
+		leftCmd := parseExpandedInput(input[:pipeIndex])
+		rightCmd := parseInput(strings.TrimSpace(input[pipeIndex+1:]))
+
+		leftCmd.PipedCmd = &rightCmd
+		return leftCmd
+	}
+
+	if definition, ok := parseFunctionDefinition(input); ok {
+		return definition
+	}
+	if input[0] == subshellOpen || (input[0] == groupOpen && isGroupOpen(input, 0)) {
+		return parseGroup(input)
+	}
+	if isKeywordAt(input, 0, loopOpen) {
+		return parseForLoop(input)
+	}
+
+	input, redirects, err := extractRedirections(input)
+	if err != nil {
+		fmt.Printf("Error processing redirection: %v\n", err)
+		return ParsedCommand{}
+	}
+
+	tokens, err := splitWords(input)
+	if err != nil {
+		fmt.Println(err)
+		return ParsedCommand{}
+	}
+	parsedArgs := tokens.words
+
+	// Leading NAME=value words are assignments, not the command
+	assignments := []Assignment{}
+	for len(parsedArgs) > 0 {
+		assignment, ok := parseAssignment(parsedArgs[0], tokens.compounds[len(assignments)])
+		if !ok {
 			break
-		} 
+		}
+		assignments = append(assignments, assignment)
+		parsedArgs = parsedArgs[1:]
+	}
+
+	if len(parsedArgs) == 0 {
+		return ParsedCommand{Assignments: assignments, Redirects: redirects}
+	}
+
+	for i := range tokens.procSubsts {
+		tokens.procSubsts[i].ArgIndex -= len(assignments)
+	}
+
+	// Compound values of arguments, as in `declare -A m=([k]=v)`, by Args index
+	compoundArgs := map[int][]string{}
+	for wordIndex, elements := range tokens.compounds {
+		if argIndex := wordIndex - len(assignments) - 1; argIndex >= 0 {
+			compoundArgs[argIndex] = elements
+		}
 	}
 
-	parsedArgs := []string{}
+	return ParsedCommand{
+		Cmd:          parsedArgs[0],
+		Args:         parsedArgs[1:],
+		Assignments:  assignments,
+		CompoundArgs: compoundArgs,
+		Redirects:    redirects,
+		ProcSubsts:   tokens.procSubsts,
+		PipedCmd:     nil,
+	}
+}
+
+// wordList is the result of splitWords
+type wordList struct {
+	words      []string
+	compounds  map[int][]string // elements of NAME=(...) words, by word index
+	procSubsts []ProcessSubstitution
+}
+
+// splitWords removes quotes, expands parameters and splits input into words
+func splitWords(input string) (wordList, error) {
+	tokens := wordList{compounds: map[int][]string{}}
 	currentArg := strings.Builder{}
+	isQuotedArg := false // quotes make an argument even when it is empty, like ''
+	isEmptyList := false // "${empty[@]}" makes no argument at all
 	isInSingleQuotes := false
 	isInDoubleQuotes := false
 
+	addWord := func() {
+		if currentArg.Len() > 0 || (isQuotedArg && !isEmptyList) {
+			tokens.words = append(tokens.words, currentArg.String())
+		}
+		currentArg.Reset()
+		isQuotedArg = false
+		isEmptyList = false
+	}
+
 	for i := 0; i < len(input); i++ {
 		char := input[i]
 
 		switch {
 		case char == singleQuote && !isInDoubleQuotes:
 			isInSingleQuotes = !isInSingleQuotes
+			isQuotedArg = true
 
 		case char == doubleQuote && !isInSingleQuotes:
 			isInDoubleQuotes = !isInDoubleQuotes
+			isQuotedArg = true
 
 		case char == whitespace && !isInSingleQuotes && !isInDoubleQuotes:
-			if currentArg.Len() > 0 {
-				parsedArgs = append(parsedArgs, currentArg.String())
-				currentArg.Reset()
-			}
+			addWord()
 			i = skipConsecutiveSpaces(input, i)
 
 		case char == backslash && !isInSingleQuotes:
 			nextIndex, success := processEscapeSequence(input, i, &currentArg, isInDoubleQuotes)
 			if !success {
-				return ParsedCommand{}
+				return wordList{}, fmt.Errorf("syntax error: unexpected end of input after '\\'")
 			}
 			i = nextIndex
 
+		case char == dollar && !isInSingleQuotes:
+			values, end, ok := expandParameter(input, i, isInDoubleQuotes)
+			if !ok {
+				currentArg.WriteByte(char)
+				continue
+			}
+			i = end
+
+			// Assignment values are not split, as in `x=$y`
+			splitFields := !isInDoubleQuotes && !isAssignmentWord(currentArg.String(), tokens.words)
+
+			// ${arr[@]} ends the current word after each element but the last
+			for j, value := range values {
+				if j > 0 {
+					isQuotedArg = true
+					addWord()
+				}
+				if !splitFields {
+					currentArg.WriteString(value)
+					continue
+				}
+
+				// Unquoted, IFS characters in the value separate words too
+				fields, leading, trailing := splitIFSFields(value, getIFS())
+				if leading {
+					addWord()
+				}
+				for k, field := range fields {
+					if k > 0 {
+						isQuotedArg = true
+						addWord()
+					}
+					currentArg.WriteString(field)
+				}
+				if trailing {
+					addWord()
+				}
+			}
+			if len(values) == 0 && currentArg.Len() == 0 {
+				isEmptyList = true
+			}
+
+		case char == subshellOpen && !isInSingleQuotes && !isInDoubleQuotes && isCompoundAssignmentStart(currentArg.String(), tokens.words):
+			end := findGroupEnd(input[i:])
+			if end == -1 {
+				return wordList{}, fmt.Errorf("syntax error: missing ')'")
+			}
+
+			elements, err := splitWords(input[i+1 : i+end])
+			if err != nil {
+				return wordList{}, err
+			}
+			if elements.words == nil {
+				elements.words = []string{}
+			}
+
+			tokens.compounds[len(tokens.words)] = elements.words
+			currentArg.WriteString(input[i : i+end+1])
+			i += end
+
+		case (char == redirIn || char == redirOut) && isProcessSubstitution(input, i) && !isInSingleQuotes && !isInDoubleQuotes:
+			substitution, nextIndex, err := parseProcessSubstitution(input, i, len(tokens.words)-1)
+			if err != nil {
+				return wordList{}, err
+			}
+			tokens.procSubsts = append(tokens.procSubsts, substitution)
+			currentArg.WriteString(substitution.Text)
+			i = nextIndex
+
 		default:
 			currentArg.WriteByte(char)
 		}
 	}
 
 	// Add the last argument if it exists
-	if currentArg.Len() > 0 {
-		parsedArgs = append(parsedArgs, currentArg.String())
-	}
+	addWord()
 
-	if len(parsedArgs) == 0 {
-		return ParsedCommand{}
+	return tokens, nil
+}
+
+// isCompoundAssignmentStart reports whether a '(' following prefix opens
+// the value list of NAME=(...)
+func isCompoundAssignmentStart(prefix string, previousWords []string) bool {
+	return strings.HasSuffix(prefix, "=") && isAssignmentWord(prefix, previousWords)
+}
+
+// isAssignmentWord reports whether the word starting with prefix assigns a
+// variable, which is only the case for leading assignments and for the
+// arguments of declare
+func isAssignmentWord(prefix string, previousWords []string) bool {
+	if !isAssignment(prefix) {
+		return false
 	}
 
-	return ParsedCommand{
-		Cmd:       parsedArgs[0],
-		Args:      parsedArgs[1:],
-		RedirType: redirType,
-		RedirFile: redirFile,
-		PipedCmd:  nil,
+	if len(previousWords) > 0 && previousWords[0] == "declare" {
+		return true
+	}
+	for _, word := range previousWords {
+		if !isAssignment(word) {
+			return false
+		}
 	}
+	return true
 }
 
 func skipConsecutiveSpaces(input string, currentIndex int) int {
@@ -127,9 +291,9 @@ func processEscapeSequence(input string, currentIndex int, builder *strings.Buil
 	escapedChar := input[currentIndex+1]
 
 	if isInDoubleQuotes {
-		// In double quotes, only ", \, and $ need escaping
+		// In double quotes, only ", \, $ and ` need escaping
 		// Other backslashes are preserved literally
-		if !(escapedChar == doubleQuote || escapedChar == backslash || escapedChar == '$') {
+		if !(escapedChar == doubleQuote || escapedChar == backslash || escapedChar == '$' || escapedChar == '`') {
 			builder.WriteByte(backslash)
 		}
 	}
@@ -138,193 +302,222 @@ func processEscapeSequence(input string, currentIndex int, builder *strings.Buil
 	return currentIndex + 1, true
 }
 
-func processRedirection(input string, pos int, redirType *RedirectionType, redirFile *string) (string, error) {
-	if pos >= len(input) {
-		return "", fmt.Errorf("redirection operator at end of input")
-	}
+// extractRedirections removes every unquoted redirection from input and
+// returns them in the order they appear, so `cmd > out 2>&1` yields two.
+func extractRedirections(input string) (string, []Redirection, error) {
+	var redirects []Redirection
+	remaining := []byte{}
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
 
-	if input[pos] == redirOut {
-		// Check for append redirection '>>' or '1>>' or '2>>'
-		if pos+1 < len(input) && input[pos+1] == redirOut {
-			if pos > 0 && input[pos-1] == '2' {
-				*redirType = AppendErrRedirection
-			} else {
-				*redirType = AppendOutRedirection
-			}
+	for i := 0; i < len(input); i++ {
+		char := input[i]
 
-			*redirFile = strings.TrimSpace(input[pos+2:])
-			return strings.TrimSpace(input[:pos-1]), nil
-		}
+		switch {
+		case char == singleQuote && !isInDoubleQuotes:
+			isInSingleQuotes = !isInSingleQuotes
+			remaining = append(remaining, char)
 
-		*redirFile = strings.TrimSpace(input[pos+1:])
+		case char == doubleQuote && !isInSingleQuotes:
+			isInDoubleQuotes = !isInDoubleQuotes
+			remaining = append(remaining, char)
 
-		// Handle stdout redirection '1>'
-		if pos > 0 && input[pos-1] == '1' {
-			*redirType = OutputRedirection
-			return strings.TrimSpace(input[:pos-1]), nil
-		} else if pos > 0 && input[pos-1] == '2' {
-			// Handle stderr redirection '2>'
-			*redirType = ErrorRedirection
-			return strings.TrimSpace(input[:pos-1]), nil
-		}
+		case char == backslash && !isInSingleQuotes && i+1 < len(input):
+			remaining = append(remaining, char, input[i+1])
+			i++
 
-		// Handle regular stdout redirection '>'
-		*redirType = OutputRedirection
-		return strings.TrimSpace(input[:pos]), nil
+		case (char == redirOut || char == redirIn) && isProcessSubstitution(input, i) && !isInSingleQuotes && !isInDoubleQuotes:
+			// <(cmd) and >(cmd) are left for the tokenizer
+			end := findGroupEnd(input[i+1:])
+			if end == -1 {
+				return "", nil, fmt.Errorf("missing ')' in process substitution")
+			}
+			remaining = append(remaining, input[i:i+end+2]...)
+			i += end + 1
 
-	} else if input[pos] == redirIn {
-		*redirType = InputRedirection
-		*redirFile = strings.TrimSpace(input[pos+1:])
-		return strings.TrimSpace(input[:pos]), nil
+		case (char == redirOut || char == redirIn) && !isInSingleQuotes && !isInDoubleQuotes:
+			redirect, nextIndex, hasFdPrefix, err := processRedirection(input, i)
+			if err != nil {
+				return "", nil, err
+			}
+			if hasFdPrefix {
+				remaining = remaining[:len(remaining)-1]
+			}
+
+			redirects = append(redirects, redirect)
+			i = nextIndex - 1
+
+		default:
+			remaining = append(remaining, char)
+		}
 	}
 
-	return input, nil
+	return strings.TrimSpace(string(remaining)), redirects, nil
 }
 
-func isOnPath(command string) (foundPath string, exists bool) {
-	pathEnv := os.Getenv("PATH")
-	if pathEnv == "" {
-		return "", false
+// processRedirection parses the operator at pos (`>`, `>>`, `<`, `2>`, `2>&1`,
+// `>&2`, ...) and its target, returning the index just past the redirection.
+func processRedirection(input string, pos int) (Redirection, int, bool, error) {
+	fd := byte('1')
+	hasFdPrefix := false
+	if pos > 0 && (input[pos-1] == '1' || input[pos-1] == '2') && (pos == 1 || input[pos-2] == whitespace) {
+		fd = input[pos-1]
+		hasFdPrefix = true
 	}
 
-	pathDirectories := strings.Split(pathEnv, pathSeparator)
+	var redirType RedirectionType
+	i := pos + 1
 
-	for _, directory := range pathDirectories {
-		if directory == "" {
-			continue
+	if input[pos] == redirIn {
+		redirType = InputRedirection
+	} else if i < len(input) && input[i] == redirOut {
+		// Append redirection '>>', '1>>' or '2>>'
+		redirType = AppendOutRedirection
+		if fd == '2' {
+			redirType = AppendErrRedirection
+		}
+		i++
+	} else if i < len(input) && input[i] == '&' {
+		// Descriptor duplication '2>&1' or '>&2'
+		if i+1 >= len(input) {
+			return Redirection{}, 0, false, fmt.Errorf("missing file descriptor after >&")
 		}
 
-		fullCommandPath := filepath.Join(directory, command)
-		if commandExists(fullCommandPath) {
-			return directory, true
+		target := input[i+1]
+		if fd == '2' && target == '1' {
+			return Redirection{Type: ErrToOutRedirection}, i + 2, hasFdPrefix, nil
+		} else if fd == '1' && target == '2' {
+			return Redirection{Type: OutToErrRedirection}, i + 2, hasFdPrefix, nil
+		}
+		return Redirection{}, 0, false, fmt.Errorf("unsupported descriptor duplication %c>&%c", fd, target)
+	} else {
+		redirType = OutputRedirection
+		if fd == '2' {
+			redirType = ErrorRedirection
 		}
 	}
 
-	return "", false
-}
+	targetPos := skipConsecutiveSpaces(input, i-1) + 1
+	if targetPos < len(input) && (input[targetPos] == redirIn || input[targetPos] == redirOut) && isProcessSubstitution(input, targetPos) {
+		substitution, closeIndex, err := parseProcessSubstitution(input, targetPos, -1)
+		if err != nil {
+			return Redirection{}, 0, false, err
+		}
+		return Redirection{Type: redirType, ProcSubst: &substitution}, closeIndex + 1, hasFdPrefix, nil
+	}
 
-func commandExists(path string) bool {
-	_, err := os.Stat(path)
-	return err == nil
-}
+	file, nextIndex := readRedirectionTarget(input, i)
+	if file == "" {
+		return Redirection{}, 0, false, fmt.Errorf("missing file name after redirection operator")
+	}
 
-func checkIfPipeStatement(input string) int {
-	isInSingleQuotes := false
-    isInDoubleQuotes := false
-    
-    for i, char := range input {
-        switch char {
-        case singleQuote:
-            if !isInDoubleQuotes {
-                isInSingleQuotes = !isInSingleQuotes
-            }
-        case doubleQuote:
-            if !isInSingleQuotes {
-                isInDoubleQuotes = !isInDoubleQuotes
-            }
-        case pipeline:
-            if !isInSingleQuotes && !isInDoubleQuotes {
-                return i
-            }
-        }
-    }
-	
-    return -1
+	return Redirection{Type: redirType, File: file}, nextIndex, hasFdPrefix, nil
 }
 
-func readUserInput() string {
-	var input strings.Builder
-
-	// Get the file descriptor for stdin
-	fd := int(os.Stdin.Fd())
+// readRedirectionTarget reads the (possibly quoted) word starting at pos.
+func readRedirectionTarget(input string, pos int) (string, int) {
+	pos = skipConsecutiveSpaces(input, pos-1) + 1
 
-	// Save the original terminal state
-	oldState, err := term.MakeRaw(fd)
-	if err != nil {
-		fmt.Printf("Error setting raw mode: %v\n", err)
-		os.Exit(1)
-	}
+	target := strings.Builder{}
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
 
-	// Restore terminal state
-	defer term.Restore(fd, oldState)
+	i := pos
+	for ; i < len(input); i++ {
+		char := input[i]
 
-	for {
-		// Read one byte at a time
-		var buf [1]byte
-		n, err := os.Stdin.Read(buf[:])
-		if err != nil || n == 0 {
+		if char == singleQuote && !isInDoubleQuotes {
+			isInSingleQuotes = !isInSingleQuotes
 			continue
 		}
-
-		char := rune(buf[0])
-
-		switch char {
-		case '\n', '\r': //  Enter key
-			fmt.Print("\n\r")
-			return input.String()
-
-		case '\t': // Tab : autocomplete
-			autoComplete(&input)
-
-		case 127, 8: // Backspace (127 is DEL, 8 is BS)
-			if input.Len() > 0 {
-				// Remove last character from input
-				currentStr := input.String()
-				input.Reset()
-				input.WriteString(currentStr[:len(currentStr)-1])
-				// Move cursor back, print space, move back again
-				fmt.Print("\b \b")
+		if char == doubleQuote && !isInSingleQuotes {
+			isInDoubleQuotes = !isInDoubleQuotes
+			continue
+		}
+		if isInDoubleQuotes && char == dollar {
+			if value, end, ok := expandVariable(input, i); ok {
+				target.WriteString(value)
+				i = end
+				continue
 			}
+		}
+		if isInSingleQuotes || isInDoubleQuotes {
+			target.WriteByte(char)
+			continue
+		}
 
-		case 3: // Ctrl+C
-			fmt.Print("\n\r")
-			term.Restore(fd, oldState) // Restore before exit
-			os.Exit(0)
-
-		case 4: // Ctrl+D (EOF)
-			fmt.Print("\n\r")
-			term.Restore(fd, oldState) // Restore before exit
-			os.Exit(0)
-
-		case 27: // Escape sequence
-			// Read the next two bytes for arrow keys or other escape sequences
-			var buf2 [2]byte
-			n, err := os.Stdin.Read(buf2[:])
-			if err != nil || n < 2 {
+		if char == whitespace || char == redirOut || char == redirIn {
+			break
+		}
+		if char == backslash && i+1 < len(input) {
+			i++
+			char = input[i]
+		} else if char == dollar {
+			if value, end, ok := expandVariable(input, i); ok {
+				target.WriteString(value)
+				i = end
 				continue
 			}
+		}
+		target.WriteByte(char)
+	}
 
-			// Check for arrow keys
-			if buf2[0] == '[' {
-				switch buf2[1] {
-				case 'A': // Up arrow - get the previos cmd
-					previousCmd := getPreviousCommand()
-
-					if previousCmd.Cmd == "" {
-						continue
-					}
+	return target.String(), i
+}
 
-					displayCmd(previousCmd, &input)
+func checkIfPipeStatement(input string) int {
+	isInSingleQuotes := false
+	isInDoubleQuotes := false
+	depth := 0
 
-				case 'B': // Down arrow - get the next cmd
-					nextCmd := getNextCommand()
+	for i := 0; i < len(input); i++ {
+		char := input[i]
 
-					if nextCmd.Cmd == "" {
-						continue
-					}
+		switch {
+		case char == backslash && !isInSingleQuotes:
+			i++ // an escaped quote does not end a double-quoted string
+		case char == singleQuote && !isInDoubleQuotes:
+			isInSingleQuotes = !isInSingleQuotes
+		case char == doubleQuote && !isInSingleQuotes:
+			isInDoubleQuotes = !isInDoubleQuotes
+		case isInSingleQuotes || isInDoubleQuotes:
+			continue
+		case char == subshellOpen || (char == groupOpen && isGroupOpen(input, i)):
+			depth++
+		case char == subshellClose || (char == groupClose && isGroupClose(input, i)):
+			depth--
+		case isKeywordAt(input, i, loopOpen):
+			depth++
+			i += len(loopOpen) - 1
+		case isKeywordAt(input, i, loopClose):
+			depth--
+			i += len(loopClose) - 1
+		case char == pipeline && depth == 0:
+			// '||' is a list operator, not a pipe
+			if i+1 < len(input) && input[i+1] == pipeline {
+				i++
+				continue
+			}
+			return i
+		}
+	}
 
-					displayCmd(nextCmd, &input)
+	return -1
+}
 
-				default: // Ignore other escape sequences
-					continue
-				}
-			}
+func readUserInput() string {
+	editor := NewLineEditor("$ ")
+	if isOptionSet("vi") {
+		editor.enableViMode()
+	}
 
-		default:
-			if char >= 32 && char < 127 {
-				input.WriteRune(char)
-				fmt.Print(string(char))
-			}
-		}
+	line, err := editor.ReadLine()
+	if errors.Is(err, errInterrupted) || errors.Is(err, errEndOfInput) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Printf("Error reading input: %v\n", err)
+		os.Exit(1)
 	}
+
+	return line
 }
@@ -0,0 +1,876 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const dollar = '$'
+
+// defaultIFS is used for field splitting when IFS is unset
+const defaultIFS = " \t\n"
+
+type VarKind int
+
+const (
+	ScalarVar VarKind = iota
+	IndexedArrayVar
+	AssocArrayVar
+)
+
+type Variable struct {
+	Kind      VarKind
+	Value     string
+	Indexed   map[int]string // may be sparse after arr[10]=x
+	Assoc     map[string]string
+	AssocKeys []string // insertion order, so listings are stable
+}
+
+// Assignment is a NAME=value, NAME[sub]=value, NAME+=value or NAME=(...) word
+type Assignment struct {
+	Name         string
+	Subscript    string
+	HasSubscript bool
+	Append       bool
+	Value        string
+	Elements     []string // for NAME=(...)
+	IsCompound   bool
+}
+
+// shellVars holds variables set in this shell. Variables inherited from the
+// environment stay in os.Environ so child processes keep seeing them.
+var shellVars = map[string]*Variable{}
+
+func newIndexedArray() *Variable {
+	return &Variable{Kind: IndexedArrayVar, Indexed: map[int]string{}}
+}
+
+func newAssocArray() *Variable {
+	return &Variable{Kind: AssocArrayVar, Assoc: map[string]string{}}
+}
+
+// indices returns the subscripts in order: ascending for indexed arrays,
+// insertion order for associative ones
+func (v *Variable) indices() []string {
+	switch v.Kind {
+	case IndexedArrayVar:
+		keys := make([]int, 0, len(v.Indexed))
+		for key := range v.Indexed {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+
+		indices := make([]string, len(keys))
+		for i, key := range keys {
+			indices[i] = strconv.Itoa(key)
+		}
+		return indices
+	case AssocArrayVar:
+		return slices.Clone(v.AssocKeys)
+	}
+	return []string{"0"}
+}
+
+func (v *Variable) values() []string {
+	var values []string
+	for _, index := range v.indices() {
+		value, _ := v.element(index)
+		values = append(values, value)
+	}
+	return values
+}
+
+func (v *Variable) element(subscript string) (string, bool) {
+	switch v.Kind {
+	case IndexedArrayVar:
+		index, err := v.arrayIndex(subscript)
+		if err != nil {
+			return "", false
+		}
+		value, ok := v.Indexed[index]
+		return value, ok
+	case AssocArrayVar:
+		value, ok := v.Assoc[subscript]
+		return value, ok
+	}
+
+	if index, err := v.arrayIndex(subscript); err == nil && index == 0 {
+		return v.Value, true
+	}
+	return "", false
+}
+
+func (v *Variable) setElement(subscript string, value string) error {
+	if v.Kind == AssocArrayVar {
+		if _, exists := v.Assoc[subscript]; !exists {
+			v.AssocKeys = append(v.AssocKeys, subscript)
+		}
+		v.Assoc[subscript] = value
+		return nil
+	}
+
+	index, err := v.arrayIndex(subscript)
+	if err != nil {
+		return err
+	}
+
+	// Writing to an index other than 0 turns a scalar into an array
+	if v.Kind == ScalarVar {
+		if index == 0 {
+			v.Value = value
+			return nil
+		}
+		v.Kind = IndexedArrayVar
+		v.Indexed = map[int]string{0: v.Value}
+		v.Value = ""
+	}
+
+	v.Indexed[index] = value
+	return nil
+}
+
+// unsetElement removes one element of an array. Unsetting element 0 of a
+// scalar empties it.
+func (v *Variable) unsetElement(subscript string) error {
+	switch v.Kind {
+	case AssocArrayVar:
+		delete(v.Assoc, subscript)
+		v.AssocKeys = slices.DeleteFunc(v.AssocKeys, func(key string) bool { return key == subscript })
+		return nil
+	case IndexedArrayVar:
+		index, err := v.arrayIndex(subscript)
+		if err != nil {
+			return err
+		}
+		delete(v.Indexed, index)
+		return nil
+	}
+
+	index, err := v.arrayIndex(subscript)
+	if err != nil {
+		return err
+	}
+	if index == 0 {
+		v.Value = ""
+	}
+	return nil
+}
+
+// arrayIndex evaluates an indexed array subscript. Negative indices count
+// back from the end like bash.
+func (v *Variable) arrayIndex(subscript string) (int, error) {
+	index, err := strconv.Atoi(strings.TrimSpace(subscript))
+	if err != nil {
+		// A bare name is evaluated like bash's arithmetic context does
+		if isValidVarName(strings.TrimSpace(subscript)) {
+			index, err = strconv.Atoi(getVar(strings.TrimSpace(subscript)))
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%s: bad array subscript", subscript)
+		}
+	}
+
+	if index < 0 {
+		index += v.nextIndex()
+		if index < 0 {
+			return 0, fmt.Errorf("%s: bad array subscript", subscript)
+		}
+	}
+	return index, nil
+}
+
+// nextIndex is one past the highest index in use, where += appends
+func (v *Variable) nextIndex() int {
+	switch v.Kind {
+	case IndexedArrayVar:
+		next := 0
+		for index := range v.Indexed {
+			next = max(next, index+1)
+		}
+		return next
+	case ScalarVar:
+		return 1
+	}
+	return len(v.Assoc)
+}
+
+func (v *Variable) copy() *Variable {
+	copied := *v
+	if v.Indexed != nil {
+		copied.Indexed = make(map[int]string, len(v.Indexed))
+		for index, value := range v.Indexed {
+			copied.Indexed[index] = value
+		}
+	}
+	if v.Assoc != nil {
+		copied.Assoc = make(map[string]string, len(v.Assoc))
+		for key, value := range v.Assoc {
+			copied.Assoc[key] = value
+		}
+		copied.AssocKeys = slices.Clone(v.AssocKeys)
+	}
+	return &copied
+}
+
+func isValidVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, char := range name {
+		isLetter := char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+		isDigit := char >= '0' && char <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getVariable returns the shell variable name, wrapping an inherited
+// environment variable as a scalar. It returns nil if name is unset.
+func getVariable(name string) *Variable {
+	if variable, ok := shellVars[name]; ok {
+		return variable
+	}
+	if value, ok := os.LookupEnv(name); ok {
+		return &Variable{Kind: ScalarVar, Value: value}
+	}
+	return nil
+}
+
+func lookupVar(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(lastExitStatus), true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "0":
+		return os.Args[0], true
+	case "#":
+		return strconv.Itoa(len(positionalParams)), true
+	}
+
+	if n, err := strconv.Atoi(name); err == nil && n > 0 {
+		if n > len(positionalParams) {
+			return "", false
+		}
+		return positionalParams[n-1], true
+	}
+
+	variable := getVariable(name)
+	if variable == nil {
+		return "", false
+	}
+
+	// $arr is the same as ${arr[0]}
+	value, _ := variable.element("0")
+	return value, true
+}
+
+func getVar(name string) string {
+	value, _ := lookupVar(name)
+	return value
+}
+
+func setVar(name string, value string) {
+	if variable, ok := shellVars[name]; ok {
+		if variable.Kind == ScalarVar {
+			variable.Value = value
+			return
+		}
+		variable.setElement("0", value)
+		return
+	}
+
+	if _, exported := os.LookupEnv(name); exported {
+		os.Setenv(name, value)
+		return
+	}
+
+	shellVars[name] = &Variable{Value: value}
+}
+
+func setArrayVar(name string, values []string) {
+	array := newIndexedArray()
+	for i, value := range values {
+		array.Indexed[i] = value
+	}
+	shellVars[name] = array
+}
+
+// getIFS returns the field separators, falling back to space, tab and
+// newline when IFS is unset. An empty IFS disables splitting.
+func getIFS() string {
+	if ifs, ok := lookupVar("IFS"); ok {
+		return ifs
+	}
+	return defaultIFS
+}
+
+// splitIFSFields splits the value of an unquoted expansion into words on
+// ifs. leading and trailing report IFS characters at either end, which end
+// the words the expansion is joined to.
+func splitIFSFields(value string, ifs string) (fields []string, leading bool, trailing bool) {
+	if ifs == "" || value == "" {
+		return []string{value}, false, false
+	}
+
+	fields = splitReadFields([]byte(value), make([]bool, len(value)), ifs, 0)
+	leading = strings.IndexByte(ifs, value[0]) >= 0 && strings.IndexByte(defaultIFS, value[0]) >= 0
+	trailing = strings.IndexByte(ifs, value[len(value)-1]) >= 0
+	return fields, leading, trailing
+}
+
+// expandVariable is expandParameter for places that need a single string,
+// such as redirection targets
+func expandVariable(input string, pos int) (value string, end int, ok bool) {
+	words, end, ok := expandParameter(input, pos, true)
+	return strings.Join(words, " "), end, ok
+}
+
+// expandString expands every parameter in s, ignoring quotes
+func expandString(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == dollar {
+			if value, end, ok := expandVariable(s, i); ok {
+				result.WriteString(value)
+				i = end
+				continue
+			}
+		}
+		result.WriteByte(s[i])
+	}
+	return result.String()
+}
+
+// expandParameter reads the `$name`, `${...}` or special parameter starting
+// at pos and returns the words it expands to and the index of its last
+// character. Only $@ and ${name[@]} style expansions produce more or fewer
+// than one word. ok is false when the '$' does not start a parameter and should
+// stay literal.
+func expandParameter(input string, pos int, isInDoubleQuotes bool) (words []string, end int, ok bool) {
+	if pos+1 >= len(input) {
+		return nil, pos, false
+	}
+
+	next := input[pos+1]
+	switch {
+	case next == '{':
+		closeIndex := strings.IndexByte(input[pos+2:], '}')
+		if closeIndex == -1 {
+			return nil, pos, false
+		}
+
+		end = pos + 2 + closeIndex
+		return expandBraced(input[pos+2:end], isInDoubleQuotes), end, true
+
+	case strings.IndexByte("?$#", next) >= 0 || (next >= '0' && next <= '9'):
+		return []string{getVar(string(next))}, pos + 1, true
+
+	case next == '@' || next == '*':
+		return joinListExpansion(positionalParams, string(next), isInDoubleQuotes), pos + 1, true
+	}
+
+	end = pos + 1
+	for end < len(input) && isValidVarName(input[pos+1:end+1]) {
+		end++
+	}
+	if end == pos+1 {
+		return nil, pos, false
+	}
+
+	return []string{getVar(input[pos+1 : end])}, end - 1, true
+}
+
+// expandBraced expands the text between ${ and }: name, name[sub],
+// name[@], name[*], #name..., !name[@] and :offset:length slices
+func expandBraced(expr string, isInDoubleQuotes bool) []string {
+	switch {
+	case strings.HasPrefix(expr, "#") && len(expr) > 1:
+		name, subscript, hasSubscript, _ := parseParameterRef(expr[1:])
+		variable := getVariable(name)
+
+		if variable == nil {
+			return []string{"0"}
+		}
+		if hasSubscript && (subscript == "@" || subscript == "*") {
+			return []string{strconv.Itoa(len(variable.indices()))}
+		}
+
+		value, _ := variable.element("0")
+		if hasSubscript {
+			value, _ = variable.element(expandString(subscript))
+		}
+		return []string{strconv.Itoa(utf8.RuneCountInString(value))}
+
+	case strings.HasPrefix(expr, "!"):
+		name, subscript, _, _ := parseParameterRef(expr[1:])
+		variable := getVariable(name)
+
+		var indices []string
+		if variable != nil {
+			indices = variable.indices()
+		}
+		return joinListExpansion(indices, subscript, isInDoubleQuotes)
+	}
+
+	name, subscript, hasSubscript, rest := parseParameterRef(expr)
+	variable := getVariable(name)
+
+	if !hasSubscript || (subscript != "@" && subscript != "*") {
+		value, _ := lookupVar(name)
+		if hasSubscript && variable != nil {
+			value, _ = variable.element(expandString(subscript))
+		}
+		if slice, isSlice := parseSlice(rest); isSlice {
+			runes := []rune(value)
+			start, stop := slice.bounds(len(runes))
+			value = string(runes[start:stop])
+		}
+		return []string{value}
+	}
+
+	var values []string
+	if variable != nil {
+		values = variable.values()
+	}
+	if slice, isSlice := parseSlice(rest); isSlice {
+		start, stop := slice.bounds(len(values))
+		values = values[start:stop]
+	}
+	return joinListExpansion(values, subscript, isInDoubleQuotes)
+}
+
+// joinListExpansion returns "${a[@]}" as separate words, and "${a[*]}" as
+// one word joined with the first character of IFS
+func joinListExpansion(values []string, subscript string, isInDoubleQuotes bool) []string {
+	if subscript == "*" && isInDoubleQuotes {
+		separator := ""
+		if ifs := getIFS(); ifs != "" {
+			separator = ifs[:1]
+		}
+		return []string{strings.Join(values, separator)}
+	}
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+// parseParameterRef splits `name[sub]rest` into its parts
+func parseParameterRef(expr string) (name string, subscript string, hasSubscript bool, rest string) {
+	end := 0
+	for end < len(expr) && isValidVarName(expr[:end+1]) {
+		end++
+	}
+	if end == 0 && expr != "" && strings.IndexByte("?$#0123456789", expr[0]) >= 0 {
+		end = 1
+	}
+	name, rest = expr[:end], expr[end:]
+
+	if strings.HasPrefix(rest, "[") {
+		if closeIndex := strings.IndexByte(rest, ']'); closeIndex != -1 {
+			return name, rest[1:closeIndex], true, rest[closeIndex+1:]
+		}
+	}
+	return name, "", false, rest
+}
+
+// sliceSpec is a parsed `:offset` or `:offset:length` suffix
+type sliceSpec struct {
+	offset    int
+	length    int
+	hasLength bool
+}
+
+func parseSlice(rest string) (sliceSpec, bool) {
+	if !strings.HasPrefix(rest, ":") {
+		return sliceSpec{}, false
+	}
+
+	offsetText, lengthText, hasLength := strings.Cut(rest[1:], ":")
+	offset, err := strconv.Atoi(strings.TrimSpace(expandString(offsetText)))
+	if err != nil {
+		return sliceSpec{}, false
+	}
+
+	spec := sliceSpec{offset: offset, hasLength: hasLength}
+	if hasLength {
+		spec.length, err = strconv.Atoi(strings.TrimSpace(expandString(lengthText)))
+		if err != nil {
+			return sliceSpec{}, false
+		}
+	}
+	return spec, true
+}
+
+// bounds clamps the slice to size; a negative offset counts from the end
+// and a negative length stops that far from the end
+func (spec sliceSpec) bounds(size int) (int, int) {
+	start := spec.offset
+	if start < 0 {
+		start = max(size+start, 0)
+	}
+	start = min(start, size)
+
+	stop := size
+	if spec.hasLength && spec.length >= 0 {
+		stop = min(start+spec.length, size)
+	} else if spec.hasLength {
+		stop = max(size+spec.length, start)
+	}
+	return start, stop
+}
+
+// isAssignment reports whether word has the form NAME=value, NAME+=value or
+// NAME[sub]=value
+func isAssignment(word string) bool {
+	_, ok := parseAssignment(word, nil)
+	return ok
+}
+
+func parseAssignment(word string, elements []string) (Assignment, bool) {
+	target, value, found := strings.Cut(word, "=")
+	if !found {
+		return Assignment{}, false
+	}
+
+	assignment := Assignment{Value: value}
+	if strings.HasSuffix(target, "+") {
+		assignment.Append = true
+		target = target[:len(target)-1]
+	}
+
+	name, subscript, hasSubscript, rest := parseParameterRef(target)
+	if !isValidVarName(name) || rest != "" {
+		return Assignment{}, false
+	}
+	assignment.Name = name
+	assignment.Subscript = subscript
+	assignment.HasSubscript = hasSubscript
+
+	if elements != nil {
+		assignment.IsCompound = true
+		assignment.Elements = elements
+	}
+	return assignment, true
+}
+
+func applyAssignments(assignments []Assignment) error {
+	for _, assignment := range assignments {
+		if err := applyAssignment(assignment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyAssignment(assignment Assignment) error {
+	name := assignment.Name
+
+	if assignment.IsCompound {
+		return assignArray(name, assignment.Elements, assignment.Append)
+	}
+
+	variable := getVariable(name)
+	if assignment.HasSubscript {
+		if _, ok := shellVars[name]; !ok {
+			// Promote an unset or inherited variable to an indexed array
+			array := newIndexedArray()
+			if variable != nil {
+				array.Indexed[0] = variable.Value
+			}
+			shellVars[name] = array
+			variable = array
+		}
+
+		subscript := expandString(assignment.Subscript)
+		value := assignment.Value
+		if assignment.Append {
+			old, _ := variable.element(subscript)
+			value = old + value
+		}
+		return variable.setElement(subscript, value)
+	}
+
+	value := assignment.Value
+	if assignment.Append {
+		value = getVar(name) + value
+	}
+	setVar(name, value)
+	return nil
+}
+
+// assignArray handles NAME=(...) and NAME+=(...). Elements written as
+// [key]=value set that subscript; the others take the next free index.
+func assignArray(name string, elements []string, appendMode bool) error {
+	variable, exists := shellVars[name]
+	if !exists || variable.Kind == ScalarVar {
+		array := newIndexedArray()
+		if exists && appendMode {
+			array.Indexed[0] = variable.Value
+		}
+		variable = array
+	} else if !appendMode {
+		if variable.Kind == AssocArrayVar {
+			variable = newAssocArray()
+		} else {
+			variable = newIndexedArray()
+		}
+	}
+
+	nextIndex := variable.nextIndex()
+	for _, element := range elements {
+		if strings.HasPrefix(element, "[") {
+			if closeIndex := strings.Index(element, "]="); closeIndex != -1 {
+				subscript := expandString(element[1:closeIndex])
+				if err := variable.setElement(subscript, element[closeIndex+2:]); err != nil {
+					return err
+				}
+				if index, err := strconv.Atoi(subscript); err == nil {
+					nextIndex = index + 1
+				}
+				continue
+			}
+		}
+
+		if variable.Kind == AssocArrayVar {
+			return fmt.Errorf("%s: %s: must use subscript when assigning associative array", name, element)
+		}
+		variable.Indexed[nextIndex] = element
+		nextIndex++
+	}
+
+	shellVars[name] = variable
+	return nil
+}
+
+// applyTempAssignments handles `NAME=value cmd`: the variables are exported
+// for the duration of cmd only. The returned func puts the old values back.
+func applyTempAssignments(assignments []Assignment) func() {
+	type savedVar struct {
+		name     string
+		shellVar *Variable
+		env      string
+		hasEnv   bool
+		hasShell bool
+	}
+	var saved []savedVar
+
+	for _, assignment := range assignments {
+		name := assignment.Name
+
+		old := savedVar{name: name}
+		old.shellVar, old.hasShell = shellVars[name]
+		old.env, old.hasEnv = os.LookupEnv(name)
+		saved = append(saved, old)
+
+		value := assignment.Value
+		if assignment.Append {
+			value = getVar(name) + value
+		}
+
+		delete(shellVars, name)
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for i := len(saved) - 1; i >= 0; i-- {
+			old := saved[i]
+			if old.hasEnv {
+				os.Setenv(old.name, old.env)
+			} else {
+				os.Unsetenv(old.name)
+			}
+			if old.hasShell {
+				shellVars[old.name] = old.shellVar
+			}
+		}
+	}
+}
+
+func copyShellVars() map[string]*Variable {
+	vars := make(map[string]*Variable, len(shellVars))
+	for name, variable := range shellVars {
+		vars[name] = variable.copy()
+	}
+	return vars
+}
+
+func handleDeclareCmd(args []string, compoundArgs map[int][]string) {
+	kind := ScalarVar
+	printMode := false
+
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && len(args[i]) > 1; i++ {
+		// -- ends the options, as in the `declare -- name=value` of -p
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 'a':
+				kind = IndexedArrayVar
+			case 'A':
+				kind = AssocArrayVar
+			case 'p':
+				printMode = true
+			default:
+				fmt.Fprintf(os.Stderr, "declare: -%c: invalid option\n", flag)
+				fmt.Fprintln(os.Stderr, "declare: usage: declare [-aAp] [name[=value] ...]")
+				lastExitStatus = 2
+				return
+			}
+		}
+	}
+
+	if i == len(args) {
+		names := make([]string, 0, len(shellVars))
+		for name := range shellVars {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		for _, name := range names {
+			fmt.Println(formatDeclaration(name, shellVars[name]))
+		}
+		return
+	}
+
+	for ; i < len(args); i++ {
+		arg := args[i]
+
+		if printMode {
+			variable := getVariable(arg)
+			if variable == nil {
+				fmt.Fprintf(os.Stderr, "declare: %s: not found\n", arg)
+				lastExitStatus = 1
+				continue
+			}
+			fmt.Println(formatDeclaration(arg, variable))
+			continue
+		}
+
+		assignment, isAssign := parseAssignment(arg, compoundArgs[i])
+		name := assignment.Name
+		if !isAssign {
+			name = arg
+		}
+		if !isValidVarName(name) {
+			fmt.Fprintf(os.Stderr, "declare: `%s': not a valid identifier\n", arg)
+			lastExitStatus = 1
+			continue
+		}
+
+		variable, exists := shellVars[name]
+		switch {
+		case kind == AssocArrayVar && (!exists || variable.Kind != AssocArrayVar):
+			if exists && variable.Kind == IndexedArrayVar {
+				fmt.Fprintf(os.Stderr, "declare: %s: cannot convert indexed to associative array\n", name)
+				lastExitStatus = 1
+				continue
+			}
+			shellVars[name] = newAssocArray()
+		case kind == IndexedArrayVar && (!exists || variable.Kind == ScalarVar):
+			array := newIndexedArray()
+			if exists {
+				array.Indexed[0] = variable.Value
+			}
+			shellVars[name] = array
+		case !exists && !isAssign:
+			shellVars[name] = &Variable{}
+		}
+
+		if isAssign {
+			if err := applyAssignment(assignment); err != nil {
+				fmt.Fprintf(os.Stderr, "declare: %v\n", err)
+				lastExitStatus = 1
+			}
+		}
+	}
+}
+
+func handleUnsetCmd(args []string) {
+	functions := false
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && len(args[i]) > 1; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 'v':
+				functions = false
+			case 'f':
+				functions = true
+			default:
+				fmt.Fprintf(os.Stderr, "unset: -%c: invalid option\n", flag)
+				fmt.Fprintln(os.Stderr, "unset: usage: unset [-f] [-v] [name ...]")
+				lastExitStatus = 2
+				return
+			}
+		}
+	}
+
+	for _, arg := range args[i:] {
+		if functions {
+			delete(shellFunctions, arg)
+			continue
+		}
+
+		name, subscript, hasSubscript, rest := parseParameterRef(arg)
+		if !isValidVarName(name) || rest != "" {
+			fmt.Fprintf(os.Stderr, "unset: `%s': not a valid identifier\n", arg)
+			lastExitStatus = 1
+			continue
+		}
+
+		if !hasSubscript {
+			delete(shellVars, name)
+			os.Unsetenv(name)
+			continue
+		}
+
+		variable, ok := shellVars[name]
+		if !ok {
+			continue
+		}
+		if err := variable.unsetElement(subscript); err != nil {
+			fmt.Fprintf(os.Stderr, "unset: %v\n", err)
+			lastExitStatus = 1
+		}
+	}
+}
+
+// formatDeclaration renders a variable the way `declare -p` prints it
+func formatDeclaration(name string, variable *Variable) string {
+	quote := func(value string) string {
+		replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+		return `"` + replacer.Replace(value) + `"`
+	}
+
+	if variable.Kind == ScalarVar {
+		return fmt.Sprintf("declare -- %s=%s", name, quote(variable.Value))
+	}
+
+	flag := "-a"
+	if variable.Kind == AssocArrayVar {
+		flag = "-A"
+	}
+
+	var elements []string
+	for _, index := range variable.indices() {
+		value, _ := variable.element(index)
+		elements = append(elements, fmt.Sprintf("[%s]=%s", index, quote(value)))
+	}
+	return fmt.Sprintf("declare %s %s=(%s)", flag, name, strings.Join(elements, " "))
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+const (
+	viInsertIndicator = "(ins) "
+	viNormalIndicator = "(cmd) "
+)
+
+// viState is the vi editing mode of a LineEditor. Every line starts in
+// insert mode, as in bash.
+type viState struct {
+	insertMode bool
+	pending    []keyPress // keys of the normal mode command being typed
+
+	// '.' replays the keys of the last change, including any text typed
+	// in the insert mode it started
+	changeKeys  []keyPress
+	isRecording bool
+	lastChange  []keyPress
+	isReplaying bool
+
+	undoStack []viSnapshot
+	register  string // text deleted or yanked, for p and P
+	lastFind  viCommand
+}
+
+type viSnapshot struct {
+	buffer []rune
+	cursor int
+}
+
+// viCommand is a parsed normal mode command: [count] [operator] action [char]
+type viCommand struct {
+	count  int  // 0 when no count was typed
+	op     rune // 'd', 'c', 'y' or 0
+	action rune // a motion, a simple command, or op again for dd, cc, yy
+	char   rune // argument of f, F, t, T and r
+}
+
+type viParseStatus int
+
+const (
+	viIncomplete viParseStatus = iota
+	viComplete
+	viInvalid
+)
+
+const (
+	viMotions        = "hlwWbBeE0^$fFtT;,"
+	viOperators      = "dcy"
+	viSimpleCommands = "iaIAxXsSDCpPr~u.vjk"
+	viChangeCommands = "iaIAxXsSDCpPr~"
+	viCharArgument   = "fFtTr"
+)
+
+func (e *LineEditor) enableViMode() {
+	e.vi = &viState{insertMode: true}
+}
+
+// modeIndicator is shown before the prompt in vi mode
+func (e *LineEditor) modeIndicator() string {
+	if e.vi == nil {
+		return ""
+	}
+	if e.vi.insertMode {
+		return viInsertIndicator
+	}
+	return viNormalIndicator
+}
+
+func (e *LineEditor) enterInsertMode() {
+	e.vi.insertMode = true
+	e.refresh()
+}
+
+func (e *LineEditor) enterNormalMode() {
+	e.vi.insertMode = false
+	if e.vi.isRecording {
+		e.vi.lastChange = append(e.vi.changeKeys, keyPress{code: keyEscape})
+		e.vi.isRecording = false
+	}
+
+	// The cursor sits on a character in normal mode, so step back off the end
+	e.cursor = max(e.cursor-1, 0)
+	e.refresh()
+}
+
+// clampNormalCursor keeps the cursor on a character, never past the end
+func (e *LineEditor) clampNormalCursor() {
+	if e.cursor >= len(e.buffer) && len(e.buffer) > 0 {
+		e.moveTo(previousGraphemeStart(e.buffer, len(e.buffer)))
+	}
+}
+
+// charsForward and charsBack step count whole characters from pos
+func (e *LineEditor) charsForward(pos, count int) int {
+	for i := 0; i < count; i++ {
+		pos = nextGraphemeEnd(e.buffer, pos)
+	}
+	return pos
+}
+
+func (e *LineEditor) charsBack(pos, count int) int {
+	for i := 0; i < count; i++ {
+		pos = previousGraphemeStart(e.buffer, pos)
+	}
+	return pos
+}
+
+func (e *LineEditor) saveUndo() {
+	e.vi.undoStack = append(e.vi.undoStack, viSnapshot{
+		buffer: slices.Clone(e.buffer),
+		cursor: e.cursor,
+	})
+}
+
+// handleViInsertKey handles keys that behave differently in vi insert
+// mode. It reports whether the key was consumed.
+func (e *LineEditor) handleViInsertKey(key keyPress) bool {
+	switch {
+	case key.code == keyEscape:
+		e.enterNormalMode()
+		return true
+	case key.alt:
+		// Esc typed quickly before a key arrives as Alt+key
+		e.enterNormalMode()
+		key.alt = false
+		e.handleViNormalKey(key)
+		return true
+	}
+
+	if e.vi.isRecording && !e.vi.isReplaying {
+		e.vi.changeKeys = append(e.vi.changeKeys, key)
+	}
+	return false
+}
+
+// handleViNormalKey handles a key in vi normal (command) mode
+func (e *LineEditor) handleViNormalKey(key keyPress) (bool, error) {
+	switch key.code {
+	case keyEnter:
+		return true, nil
+	case keyControl:
+		switch key.char {
+		case 'c':
+			return false, errInterrupted
+		case 'd':
+			if len(e.buffer) == 0 {
+				return false, errEndOfInput
+			}
+		case 'l':
+			e.handleEmacsKey(key)
+		case 'r', 's':
+			e.startSearch(key.char == 'r')
+		}
+		return false, nil
+	case keyLeft:
+		key = keyPress{code: keyRune, char: 'h'}
+	case keyRight:
+		key = keyPress{code: keyRune, char: 'l'}
+	case keyHome:
+		key = keyPress{code: keyRune, char: '0'}
+	case keyEnd:
+		key = keyPress{code: keyRune, char: '$'}
+	case keyUp:
+		key = keyPress{code: keyRune, char: 'k'}
+	case keyDown:
+		key = keyPress{code: keyRune, char: 'j'}
+	case keyBackspace:
+		key = keyPress{code: keyRune, char: 'h'}
+	case keyEscape:
+		e.vi.pending = nil
+		return false, nil
+	}
+
+	if key.code != keyRune {
+		return false, nil
+	}
+
+	e.vi.pending = append(e.vi.pending, key)
+	cmd, status := parseViCommand(e.vi.pending)
+
+	switch status {
+	case viIncomplete:
+		return false, nil
+	case viInvalid:
+		e.vi.pending = nil
+		fmt.Print("\a") // ASCII Bell
+		return false, nil
+	}
+
+	keys := e.vi.pending
+	e.vi.pending = nil
+
+	if isViChange(cmd) && !e.vi.isReplaying {
+		e.vi.changeKeys = keys
+		e.vi.isRecording = true
+	}
+
+	submit, err := e.executeViCommand(cmd)
+
+	// Changes that stay in normal mode are complete now
+	if e.vi.isRecording && !e.vi.insertMode {
+		e.vi.lastChange = e.vi.changeKeys
+		e.vi.isRecording = false
+	}
+
+	return submit, err
+}
+
+func isViChange(cmd viCommand) bool {
+	return cmd.op == 'd' || cmd.op == 'c' || strings.ContainsRune(viChangeCommands, cmd.action)
+}
+
+// parseViCommand parses the keys typed so far in normal mode
+func parseViCommand(keys []keyPress) (viCommand, viParseStatus) {
+	var cmd viCommand
+	i := 0
+
+	readCount := func() int {
+		count := 0
+		for i < len(keys) && keys[i].char >= '0' && keys[i].char <= '9' {
+			// A leading 0 is the motion to the start of the line
+			if count == 0 && keys[i].char == '0' {
+				break
+			}
+			count = count*10 + int(keys[i].char-'0')
+			i++
+		}
+		return count
+	}
+
+	cmd.count = readCount()
+	if i >= len(keys) {
+		return cmd, viIncomplete
+	}
+
+	if strings.ContainsRune(viOperators, keys[i].char) {
+		cmd.op = keys[i].char
+		i++
+
+		if motionCount := readCount(); motionCount > 0 {
+			cmd.count = max(cmd.count, 1) * motionCount
+		}
+		if i >= len(keys) {
+			return cmd, viIncomplete
+		}
+	}
+
+	cmd.action = keys[i].char
+	i++
+
+	if cmd.op != 0 && cmd.action == cmd.op {
+		return cmd, viComplete
+	}
+
+	isMotion := strings.ContainsRune(viMotions, cmd.action)
+	if !isMotion && (cmd.op != 0 || !strings.ContainsRune(viSimpleCommands, cmd.action)) {
+		return cmd, viInvalid
+	}
+
+	if strings.ContainsRune(viCharArgument, cmd.action) {
+		if i >= len(keys) {
+			return cmd, viIncomplete
+		}
+		cmd.char = keys[i].char
+	}
+
+	return cmd, viComplete
+}
+
+func (e *LineEditor) executeViCommand(cmd viCommand) (bool, error) {
+	count := max(cmd.count, 1)
+
+	if cmd.op != 0 {
+		e.applyViOperator(cmd)
+		return false, nil
+	}
+
+	if strings.ContainsRune(viMotions, cmd.action) {
+		if target, _, ok := e.viMotion(cmd, false); ok {
+			e.moveTo(target)
+			e.clampNormalCursor()
+		} else {
+			fmt.Print("\a") // ASCII Bell
+		}
+		return false, nil
+	}
+
+	if strings.ContainsRune(viChangeCommands, cmd.action) {
+		e.saveUndo()
+	}
+
+	switch cmd.action {
+	case 'i':
+		e.enterInsertMode()
+	case 'a':
+		e.cursor = min(e.cursor+1, len(e.buffer))
+		e.enterInsertMode()
+	case 'I':
+		e.cursor = e.firstNonBlank()
+		e.enterInsertMode()
+	case 'A':
+		e.cursor = len(e.buffer)
+		e.enterInsertMode()
+	case 'x':
+		e.viDelete(e.cursor, e.charsForward(e.cursor, count))
+		e.clampNormalCursor()
+	case 'X':
+		e.viDelete(e.charsBack(e.cursor, count), e.cursor)
+	case 's':
+		e.viDelete(e.cursor, e.charsForward(e.cursor, count))
+		e.enterInsertMode()
+	case 'S':
+		e.viDelete(0, len(e.buffer))
+		e.enterInsertMode()
+	case 'D':
+		e.viDelete(e.cursor, len(e.buffer))
+		e.clampNormalCursor()
+	case 'C':
+		e.viDelete(e.cursor, len(e.buffer))
+		e.enterInsertMode()
+	case 'p', 'P':
+		e.viPut(cmd.action == 'p', count)
+	case 'r':
+		if e.cursor+count > len(e.buffer) {
+			fmt.Print("\a") // ASCII Bell
+			break
+		}
+		for i := 0; i < count; i++ {
+			e.buffer[e.cursor+i] = cmd.char
+		}
+		e.cursor += count - 1
+		e.refresh()
+	case '~':
+		end := min(e.cursor+count, len(e.buffer))
+		for i := e.cursor; i < end; i++ {
+			if unicode.IsUpper(e.buffer[i]) {
+				e.buffer[i] = unicode.ToLower(e.buffer[i])
+			} else {
+				e.buffer[i] = unicode.ToUpper(e.buffer[i])
+			}
+		}
+		e.cursor = end
+		e.refresh()
+		e.clampNormalCursor()
+	case 'u':
+		e.viUndo()
+	case '.':
+		e.viRepeat(count)
+	case 'k':
+		e.historyPrevious()
+		e.clampNormalCursor()
+	case 'j':
+		e.historyNext()
+		e.clampNormalCursor()
+	case 'v':
+		return e.editBufferInEditor()
+	}
+
+	return false, nil
+}
+
+// applyViOperator runs d, c or y over the range covered by the motion,
+// or over the whole line for dd, cc and yy
+func (e *LineEditor) applyViOperator(cmd viCommand) {
+	start, end := 0, len(e.buffer)
+
+	if cmd.action != cmd.op {
+		motion := cmd
+		// cw on a word changes to the end of the word, like ce
+		if cmd.op == 'c' && (cmd.action == 'w' || cmd.action == 'W') && e.cursor < len(e.buffer) && !unicode.IsSpace(e.buffer[e.cursor]) {
+			motion.action = map[rune]rune{'w': 'e', 'W': 'E'}[cmd.action]
+		}
+
+		target, inclusive, ok := e.viMotion(motion, true)
+		if !ok {
+			fmt.Print("\a") // ASCII Bell
+			return
+		}
+
+		start, end = min(e.cursor, target), max(e.cursor, target)
+		if inclusive {
+			end = min(end+1, len(e.buffer))
+		}
+	}
+
+	switch cmd.op {
+	case 'y':
+		e.vi.register = string(e.buffer[start:end])
+		e.moveTo(start)
+	case 'd':
+		e.saveUndo()
+		e.viDelete(start, end)
+		e.clampNormalCursor()
+	case 'c':
+		e.saveUndo()
+		e.viDelete(start, end)
+		e.enterInsertMode()
+	}
+}
+
+// viDelete removes buffer[start:end] into the register
+func (e *LineEditor) viDelete(start, end int) {
+	start = max(start, 0)
+	end = min(end, len(e.buffer))
+	if start >= end {
+		return
+	}
+
+	e.vi.register = string(e.buffer[start:end])
+	e.deleteRange(start, end)
+}
+
+func (e *LineEditor) viPut(after bool, count int) {
+	if e.vi.register == "" {
+		return
+	}
+
+	pos := e.cursor
+	if after && len(e.buffer) > 0 {
+		pos++
+	}
+
+	text := []rune(strings.Repeat(e.vi.register, count))
+	e.buffer = slices.Concat(e.buffer[:pos], text, e.buffer[pos:])
+	e.cursor = pos + len(text) - 1
+	e.refresh()
+}
+
+func (e *LineEditor) viUndo() {
+	if len(e.vi.undoStack) == 0 {
+		fmt.Print("\a") // ASCII Bell
+		return
+	}
+
+	last := e.vi.undoStack[len(e.vi.undoStack)-1]
+	e.vi.undoStack = e.vi.undoStack[:len(e.vi.undoStack)-1]
+
+	e.buffer = last.buffer
+	e.cursor = last.cursor
+	e.refresh()
+	e.clampNormalCursor()
+}
+
+// viRepeat replays the keys of the last change
+func (e *LineEditor) viRepeat(count int) {
+	if len(e.vi.lastChange) == 0 {
+		return
+	}
+
+	e.vi.isReplaying = true
+	defer func() { e.vi.isReplaying = false }()
+
+	change := slices.Clone(e.vi.lastChange)
+	for i := 0; i < count; i++ {
+		for _, key := range change {
+			e.handleKey(key)
+		}
+	}
+}
+
+// viMotion returns where the motion of cmd moves the cursor and whether
+// an operator over it includes the character at the target
+func (e *LineEditor) viMotion(cmd viCommand, forOperator bool) (int, bool, bool) {
+	count := max(cmd.count, 1)
+	pos := e.cursor
+	size := len(e.buffer)
+
+	switch cmd.action {
+	case 'h':
+		return e.charsBack(pos, count), false, pos > 0
+	case 'l':
+		target := e.charsForward(pos, count)
+		if !forOperator && target >= size {
+			target = previousGraphemeStart(e.buffer, size)
+		}
+		return target, false, pos < size
+	case '0':
+		return 0, false, true
+	case '^':
+		return e.firstNonBlank(), false, true
+	case '$':
+		return max(size-1, 0), size > 0, true
+	case 'w', 'W':
+		for i := 0; i < count; i++ {
+			pos = e.nextViWordStart(pos, cmd.action == 'W')
+		}
+		if !forOperator {
+			pos = min(pos, max(size-1, 0))
+		}
+		return pos, false, true
+	case 'b', 'B':
+		for i := 0; i < count; i++ {
+			pos = e.previousViWordStart(pos, cmd.action == 'B')
+		}
+		return pos, false, true
+	case 'e', 'E':
+		for i := 0; i < count; i++ {
+			pos = e.nextViWordEnd(pos, cmd.action == 'E')
+		}
+		return pos, true, true
+	case 'f', 'F', 't', 'T':
+		e.vi.lastFind = cmd
+		return e.findChar(cmd.action, cmd.char, count)
+	case ';', ',':
+		if e.vi.lastFind.action == 0 {
+			return pos, false, false
+		}
+		action := e.vi.lastFind.action
+		if cmd.action == ',' {
+			action = map[rune]rune{'f': 'F', 'F': 'f', 't': 'T', 'T': 't'}[action]
+		}
+		return e.findChar(action, e.vi.lastFind.char, count)
+	}
+
+	return pos, false, false
+}
+
+// findChar implements f, F, t and T: f and t search forward and include
+// the target, F and T search backward and stop short of the cursor
+func (e *LineEditor) findChar(action rune, char rune, count int) (int, bool, bool) {
+	pos := e.cursor
+	forward := action == 'f' || action == 't'
+
+	for found := 0; found < count; {
+		if forward {
+			pos++
+			// t stops before the char, so skip one already adjacent to the cursor
+			if action == 't' && found == 0 && pos == e.cursor+1 && pos+1 < len(e.buffer) && e.buffer[pos] == char {
+				continue
+			}
+		} else {
+			pos--
+		}
+		if pos < 0 || pos >= len(e.buffer) {
+			return e.cursor, false, false
+		}
+		if e.buffer[pos] == char {
+			found++
+		}
+	}
+
+	switch action {
+	case 't':
+		pos--
+	case 'T':
+		pos++
+	}
+	return pos, forward, true
+}
+
+// viCharClass groups characters into vi words: letters, digits and
+// underscore form one class and other non-blank characters another. For
+// WORD motions every non-blank character is in the same class.
+func viCharClass(char rune, bigWord bool) int {
+	switch {
+	case unicode.IsSpace(char):
+		return 0
+	case bigWord || char == '_' || unicode.IsLetter(char) || unicode.IsDigit(char):
+		return 1
+	}
+	return 2
+}
+
+func (e *LineEditor) nextViWordStart(pos int, bigWord bool) int {
+	size := len(e.buffer)
+	if pos >= size {
+		return size
+	}
+
+	class := viCharClass(e.buffer[pos], bigWord)
+	for pos < size && class != 0 && viCharClass(e.buffer[pos], bigWord) == class {
+		pos++
+	}
+	for pos < size && unicode.IsSpace(e.buffer[pos]) {
+		pos++
+	}
+	return pos
+}
+
+func (e *LineEditor) previousViWordStart(pos int, bigWord bool) int {
+	pos--
+	for pos > 0 && unicode.IsSpace(e.buffer[pos]) {
+		pos--
+	}
+	if pos <= 0 {
+		return 0
+	}
+
+	class := viCharClass(e.buffer[pos], bigWord)
+	for pos > 0 && viCharClass(e.buffer[pos-1], bigWord) == class {
+		pos--
+	}
+	return pos
+}
+
+func (e *LineEditor) nextViWordEnd(pos int, bigWord bool) int {
+	size := len(e.buffer)
+	pos++
+	for pos < size && unicode.IsSpace(e.buffer[pos]) {
+		pos++
+	}
+	if pos >= size {
+		return max(size-1, 0)
+	}
+
+	class := viCharClass(e.buffer[pos], bigWord)
+	for pos+1 < size && viCharClass(e.buffer[pos+1], bigWord) == class {
+		pos++
+	}
+	return pos
+}
+
+func (e *LineEditor) firstNonBlank() int {
+	pos := 0
+	for pos < len(e.buffer) && unicode.IsSpace(e.buffer[pos]) {
+		pos++
+	}
+	return pos
+}